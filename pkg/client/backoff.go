@@ -0,0 +1,103 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// errGiveUp is returned when the reconnect policy is exhausted
+var errGiveUp = errors.New("give up reconnecting")
+
+// backoff is an exponential backoff with jitter for reconnecting.
+//
+// The n-th delay is a random value in [d/2, d], d = min * factor^n and
+// capped by max. The jitter spreads the reconnects of many clients when
+// the server restarts.
+//
+// A successful handshake restarts the give-up counters, but the delays
+// keep growing until a link stays up for max, see Connected and Up.
+type backoff struct {
+	min    time.Duration
+	max    time.Duration
+	factor float64
+
+	// give up after maxRetries failures or maxDuration since the first
+	// failure, 0 means never give up
+	maxRetries  int
+	maxDuration time.Duration
+
+	// attempts and start are the failures since the last handshake, level
+	// is the retries since the last stable link
+	attempts int
+	start    time.Time
+	level    int
+	rand     *rand.Rand
+}
+
+func newBackoff(min, max time.Duration, factor float64, maxRetries int, maxDuration time.Duration) *backoff {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	if factor < 1 {
+		factor = 2
+	}
+	return &backoff{
+		min:         min,
+		max:         max,
+		factor:      factor,
+		maxRetries:  maxRetries,
+		maxDuration: maxDuration,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next return the delay before the next retry
+func (b *backoff) Next() (time.Duration, error) {
+	if b.attempts == 0 {
+		b.start = time.Now()
+	}
+	b.attempts++
+	b.level++
+
+	if b.maxRetries > 0 && b.attempts > b.maxRetries {
+		return 0, errGiveUp
+	}
+	if b.maxDuration > 0 && time.Since(b.start) >= b.maxDuration {
+		return 0, errGiveUp
+	}
+
+	d := float64(b.min)
+	for i := 1; i < b.level && d < float64(b.max); i++ {
+		d *= b.factor
+	}
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+
+	half := int64(d / 2)
+	return time.Duration(half + b.rand.Int63n(half+1)), nil
+}
+
+// Attempts return the failures since the last handshake
+func (b *backoff) Attempts() int {
+	return b.attempts
+}
+
+// Connected should be called after a successful handshake, the failures
+// are forgotten and maxDuration starts again from the next failure
+func (b *backoff) Connected() {
+	b.attempts = 0
+}
+
+// Up should be called when a connection is broken after it was up for d.
+// The delays start from min again only if it was up for max at least, so
+// they still grow against a server which drops every link at once.
+func (b *backoff) Up(d time.Duration) {
+	if d >= b.max {
+		b.level = 0
+	}
+}
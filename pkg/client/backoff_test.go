@@ -0,0 +1,105 @@
+package client
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_backoff_Next(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second, 2, 0, 0)
+	b.rand = rand.New(rand.NewSource(1))
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10, 10} {
+		max *= time.Second
+		d, err := b.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d < max/2 || d > max {
+			t.Errorf("delay %d is %s, expect in [%s, %s]", i+1, d, max/2, max)
+		}
+	}
+	if b.Attempts() != 7 {
+		t.Errorf("got %d attempts, expect 7", b.Attempts())
+	}
+}
+
+func Test_backoff_Jitter(t *testing.T) {
+	b := newBackoff(time.Second, time.Second, 2, 0, 0)
+	b.rand = rand.New(rand.NewSource(1))
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		d, _ := b.Next()
+		seen[d] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("only %d different delays in 20, the jitter is too small", len(seen))
+	}
+}
+
+func Test_backoff_GiveUp(t *testing.T) {
+	b := newBackoff(time.Second, time.Second, 2, 3, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := b.Next(); err != nil {
+			t.Fatalf("retry %d: %s", i+1, err)
+		}
+	}
+	if _, err := b.Next(); err != errGiveUp {
+		t.Errorf("got %v after max retries, expect %v", err, errGiveUp)
+	}
+
+	b = newBackoff(time.Second, time.Second, 2, 0, time.Minute)
+	if _, err := b.Next(); err != nil {
+		t.Fatal(err)
+	}
+	b.start = time.Now().Add(-time.Minute)
+	if _, err := b.Next(); err != errGiveUp {
+		t.Errorf("got %v after max duration, expect %v", err, errGiveUp)
+	}
+}
+
+func Test_backoff_Up(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second, 2, 0, 0)
+	b.rand = rand.New(rand.NewSource(1))
+	b.Next()
+	b.Next()
+
+	// a link dropped at once does not reset the delays
+	b.Connected()
+	b.Up(time.Second)
+	if d, _ := b.Next(); d < 2*time.Second {
+		t.Errorf("delay is %s after a short link, expect it grows", d)
+	}
+	b.Connected()
+	b.Up(10 * time.Second)
+	if d, _ := b.Next(); d > time.Second {
+		t.Errorf("delay is %s after a stable link, expect at most %s", d, time.Second)
+	}
+}
+
+func Test_backoff_Connected(t *testing.T) {
+	// every link is up for a while but shorter than max
+	b := newBackoff(time.Second, 30*time.Second, 2, 3, time.Minute)
+	for i := 0; i < 10; i++ {
+		if _, err := b.Next(); err != nil {
+			t.Fatalf("retry after link %d: %s", i+1, err)
+		}
+		if b.Attempts() != 1 {
+			t.Fatalf("got %d attempts after link %d, expect 1", b.Attempts(), i+1)
+		}
+		// the time connected is not counted in max duration
+		b.start = time.Now().Add(-2 * time.Minute)
+		b.Connected()
+		b.Up(20 * time.Second)
+	}
+
+	// the failures after the last handshake are counted
+	for i := 0; i < 3; i++ {
+		if _, err := b.Next(); err != nil {
+			t.Fatalf("retry %d: %s", i+1, err)
+		}
+	}
+	if _, err := b.Next(); err != errGiveUp {
+		t.Errorf("got %v after max retries, expect %v", err, errGiveUp)
+	}
+}
@@ -2,11 +2,12 @@ package client
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -15,12 +16,15 @@ import (
 	"github.com/ooclab/es"
 	"github.com/ooclab/es/ecrypt"
 	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/ratelimit"
+	esutil "github.com/ooclab/es/util"
+	"github.com/ooclab/otunnel/pkg/spec"
 	"github.com/ooclab/otunnel/pkg/util"
 )
 
 // StartDefaultConnect start connection to a default server
-func StartDefaultConnect(addr string) (net.Conn, error) {
-	rawConn, err := net.Dial("tcp", addr)
+func StartDefaultConnect(addr string, timeout time.Duration, opts *esutil.DialOptions) (net.Conn, error) {
+	rawConn, err := opts.Dial("tcp", addr, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -29,42 +33,115 @@ func StartDefaultConnect(addr string) (net.Conn, error) {
 }
 
 // StartAESConnect start connection to a aes server
-func StartAESConnect(addr string, secret []byte) (net.Conn, error) {
-	return StartDefaultConnect(addr)
-}
-
-// StartTLSConnect start connection to a tls server
-func StartTLSConnect(addr string, caFile string, certFile string, keyFile string) (net.Conn, error) {
-	conn, err := tls.Dial(
-		"tcp",
-		addr,
-		&tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         "otunnelDefaultServer",
-		},
-	)
+func StartAESConnect(addr string, secret []byte, timeout time.Duration, opts *esutil.DialOptions) (net.Conn, error) {
+	return StartDefaultConnect(addr, timeout, opts)
+}
+
+// StartTLSConnect start connection to a tls server, the server certificate
+// is pinned if fingerprints is not empty
+func StartTLSConnect(addr string, caFile string, certFile string, keyFile string, timeout time.Duration, opts *esutil.DialOptions, fingerprints []string) (net.Conn, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: false,
+		ServerName:         "otunnelDefaultServer",
+	}
+	if len(fingerprints) > 0 {
+		// the pinned certificate is trusted, no matter who signed it
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyFingerprint(fingerprints)
+	}
+
+	rawConn, err := opts.Dial("tcp", addr, timeout)
 	if err != nil {
 		logrus.Errorf("connect to %s failed: %s", addr, err)
 		return nil, err
 	}
+	conn := tls.Client(rawConn, config)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
 
 	return conn, nil
 }
 
+// verifyFingerprint check the server certificate matches any fingerprint
+func verifyFingerprint(fingerprints []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server has no certificate")
+		}
+		fp := util.CertFingerprint(rawCerts[0])
+		for _, expected := range fingerprints {
+			if fp == expected {
+				return nil
+			}
+		}
+		return fmt.Errorf("server certificate %s is not the expected one", fp)
+	}
+}
+
 // Client define a client object
 type Client struct {
 	Proto   string
 	Type    string
 	link    *link.Link
-	tunnels []string
-
-	addr string
+	tunnels []*spec.Spec
+
+	// statuses are the states of tunnels, written to statusFile with the
+	// stats of tunnelLink, see status.go
+	statuses       []*tunnelStatus
+	tunnelLink     *link.Link
+	statusFile     string
+	statusInterval time.Duration
+	statusMutex    sync.Mutex
+
+	// for resuming the link after the connection is broken
+	resume      bool
+	linkID      uint32
+	resumeToken string
+
+	// addr is host:port or srv:NAME, see discovery.go. server is the one
+	// connected now, the P2P requests must go to it.
+	addr     string
+	server   server
+	resolver *net.Resolver
+
+	// fingerprints pin the server certificate, srvFingerprint means they
+	// are read from the TXT records of the SRV name
+	fingerprints   []string
+	srvFingerprint bool
 
 	// aes connection needed!
 	secret []byte
 
 	keepaliveInterval time.Duration
 
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	// dialOptions is the socket options of the connection to server, and
+	// the default ones of the connections to the targets of tunnels
+	dialOptions *esutil.DialOptions
+	backoff     *backoff
+
+	// rate limits of the link in bytes per second, 0 means no limit
+	uploadLimit   int64
+	downloadLimit int64
+	limitBurst    int64
+
+	// name is registered in server for the peers, peer is the name of
+	// the client which the tunnels are opened to, see p2p.go. peerSecret
+	// is sent to the peer, and the offers of peers are checked by it.
+	name       string
+	peer       string
+	peerSecret string
+	p2pWaits   map[uint32]chan string
+	p2pMutex   sync.Mutex
+	linkMutex  sync.Mutex
+
 	// tls connection needed!
 	caFile   string
 	keyFile  string
@@ -88,12 +165,74 @@ func newClient(c *cli.Context) (*Client, error) {
 		caFile:            c.String("ca"),
 		certFile:          c.String("cert"),
 		keyFile:           c.String("key"),
-		tunnels:           c.StringSlice("tunnel"),
+		resume:            c.BoolT("resume"),
+		name:              c.String("name"),
+		peer:              c.String("peer"),
+		peerSecret:        c.String("peer-secret"),
+		resolver:          newResolver(c.String("dns")),
+		srvFingerprint:    c.Bool("srv-fingerprint"),
+		statusFile:        c.String("status-file"),
+		statusInterval:    c.Duration("status-interval"),
+		p2pWaits:          map[uint32]chan string{},
+		dialTimeout:       c.Duration("dial-timeout"),
+		handshakeTimeout:  c.Duration("handshake-timeout"),
+		backoff: newBackoff(
+			c.Duration("retry-min"),
+			c.Duration("retry-max"),
+			c.Float64("retry-factor"),
+			c.Int("max-retries"),
+			c.Duration("max-retry-duration"),
+		),
 	}
 
+	var err error
+	sizeFlag := func(name string) int64 {
+		v, e := util.ParseSize(c.String(name))
+		if e != nil && err == nil {
+			err = fmt.Errorf("--%s: %s", name, e)
+		}
+		return v
+	}
+	client.uploadLimit = sizeFlag("upload-limit")
+	client.downloadLimit = sizeFlag("download-limit")
+	client.limitBurst = sizeFlag("limit-burst")
+	if err != nil {
+		return nil, err
+	}
+	if client.dialOptions, err = util.ParseDialOptions(c.String); err != nil {
+		return nil, err
+	}
+	if v := c.String("fingerprint"); v != "" {
+		fp, err := util.ParseFingerprint(v)
+		if err != nil {
+			return nil, fmt.Errorf("--fingerprint: %s", err)
+		}
+		client.fingerprints = []string{fp}
+	}
+	if client.name != "" && client.peerSecret == "" {
+		return nil, errors.New("--name needs --peer-secret, the peers are checked by it")
+	}
+	if client.srvFingerprint && !strings.HasPrefix(addr, srvPrefix) {
+		return nil, fmt.Errorf("--srv-fingerprint needs a %sNAME server address", srvPrefix)
+	}
+	pinned := len(client.fingerprints) > 0 || client.srvFingerprint
+
+	for _, value := range c.StringSlice("tunnel") {
+		s, err := spec.Parse(value)
+		if err != nil {
+			fmt.Printf("tunnel format: %q or %q\n", spec.LegacyFormat, spec.URLFormat)
+			return nil, err
+		}
+		client.tunnels = append(client.tunnels, s)
+	}
+	client.statuses = newTunnelStatuses(client.tunnels)
+
 	if len(client.secret) > 0 {
+		if pinned {
+			return nil, errors.New("the server fingerprint is verified by TLS, it can not be used with --secret")
+		}
 		client.Type = "aes"
-	} else if len(client.certFile) > 0 && len(client.keyFile) > 0 {
+	} else if c.Bool("tls") || pinned || (len(client.certFile) > 0 && len(client.keyFile) > 0) {
 		client.Type = "tls"
 	} else {
 		client.Type = "default"
@@ -102,34 +241,82 @@ func newClient(c *cli.Context) (*Client, error) {
 	return client, nil
 }
 
-func (client *Client) connect() (es.Conn, error) {
+func (client *Client) connect() (es.Conn, *handshakeResult, error) {
 	switch client.Proto {
 	case "tcp":
 		return client.connectTCP()
 	default:
 		logrus.Errorf("unknown proto : %s", client.Proto)
-		return nil, errors.New("unknown link proto")
+		return nil, nil, errors.New("unknown link proto")
+	}
+}
+
+func (client *Client) connectTCP() (es.Conn, *handshakeResult, error) {
+	rawConn, conn, err := client.dialTCP()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Important! the server may accept but never answer
+	if client.handshakeTimeout > 0 {
+		rawConn.SetDeadline(time.Now().Add(client.handshakeTimeout))
+	}
+
+	hs, err := handshake(conn, client.handshakeRequest())
+	if err != nil {
+		logrus.Errorf("handshake failed: %s", err)
+		conn.Close()
+		return nil, nil, err
 	}
+
+	// Important! cancel timeout!
+	rawConn.SetDeadline(time.Time{})
+
+	return conn, hs, nil
 }
 
-func (client *Client) connectTCP() (es.Conn, error) {
-	// logrus.Debugf("connect to %s", client.addr)
+// dialTCP connect to the server, return the raw conn and the es conn on it.
+// The server of a resumable link is tried first, the link is only on it.
+func (client *Client) dialTCP() (net.Conn, es.Conn, error) {
+	servers, err := client.servers()
+	if err != nil {
+		logrus.Errorf("resolve %s failed: %s", client.addr, err)
+		return nil, nil, err
+	}
+	if client.link != nil && client.resumeToken != "" {
+		servers = preferServer(servers, client.currentServer().addr)
+	}
+
+	for _, s := range servers {
+		var rawConn net.Conn
+		var conn es.Conn
+		if rawConn, conn, err = client.dialServer(s); err == nil {
+			client.linkMutex.Lock()
+			client.server = s
+			client.linkMutex.Unlock()
+			return rawConn, conn, nil
+		}
+	}
+	return nil, nil, err
+}
 
+// dialServer connect to server s
+func (client *Client) dialServer(s server) (net.Conn, es.Conn, error) {
 	var rawConn net.Conn
 	var err error
 
 	switch client.Type {
 	case "tls":
-		rawConn, err = StartTLSConnect(client.addr, client.caFile, client.certFile, client.keyFile)
+		rawConn, err = StartTLSConnect(s.addr, client.caFile, client.certFile, client.keyFile, client.dialTimeout, client.dialOptions, s.fingerprints)
 	case "aes":
-		rawConn, err = StartAESConnect(client.addr, client.secret)
+		rawConn, err = StartAESConnect(s.addr, client.secret, client.dialTimeout, client.dialOptions)
 	default:
-		rawConn, err = StartDefaultConnect(client.addr)
+		rawConn, err = StartDefaultConnect(s.addr, client.dialTimeout, client.dialOptions)
 	}
 
 	if err != nil {
-		logrus.Errorf("connect to %s failed: %s", client.addr, err)
-		return nil, err
+		logrus.Errorf("connect to %s failed: %s", s.addr, err)
+		return nil, nil, err
 	}
 
 	logrus.Debugf("connect to %s success", rawConn.RemoteAddr())
@@ -143,97 +330,152 @@ func (client *Client) connectTCP() (es.Conn, error) {
 	} else {
 		conn = es.NewBaseConn(rawConn)
 	}
+	return rawConn, conn, nil
+}
 
-	if err := handshake(conn); err != nil {
-		logrus.Errorf("handshake failed: %s", err)
-		conn.Close()
-		return nil, err
-	}
+// currentServer return the server connected now
+func (client *Client) currentServer() server {
+	client.linkMutex.Lock()
+	defer client.linkMutex.Unlock()
+	return client.server
+}
 
-	return conn, nil
+func (client *Client) handshakeRequest() map[string]interface{} {
+	req := map[string]interface{}{
+		"action": "new",
+		// we answer the opens of channels, see link.LinkConfig.LegacyChannels
+		"channel_open": true,
+	}
+	if client.name != "" {
+		req["name"] = client.name
+	}
+	// the download limit is enforced by server
+	if client.downloadLimit > 0 {
+		req["download_limit"] = client.downloadLimit
+		req["limit_burst"] = client.limitBurst
+	}
+	if !client.resume {
+		return req
+	}
+	req["resume"] = true
+	if client.link != nil && client.resumeToken != "" {
+		// the link is not bound now, RecvCount is stable
+		req["action"] = "resume"
+		req["link_id"] = client.linkID
+		req["resume_token"] = client.resumeToken
+		req["recv"] = client.link.RecvCount()
+	}
+	return req
 }
 
-// Start run a server
-func (client *Client) Start() {
+// Start run a client, it returns only when the reconnect policy give up
+func (client *Client) Start() error {
 	switch client.Proto {
 	case "tcp":
-		client.startTCP()
+		return client.startTCP()
 	default:
 		logrus.Errorf("unknown proto : %s", client.Proto)
+		return errors.New("unknown link proto")
 	}
 }
 
-func (client *Client) startTCP() {
+func (client *Client) startTCP() error {
+	if client.peer != "" {
+		go client.servePeer()
+	}
+	if client.statusFile != "" {
+		go client.serveStatus()
+	}
 
+	b := client.backoff
 	for {
-		conn, err := client.connect()
-		if err != nil {
-			time.Sleep(1 * time.Second)
-			continue
+		conn, hs, err := client.connect()
+		if err == nil {
+			b.Connected()
+			start := time.Now()
+			client.serve(conn, hs)
+			b.Up(time.Since(start))
 		}
 
-		l := link.NewLink(&link.LinkConfig{
-			IsServerSide:      false,
-			KeepaliveInterval: client.keepaliveInterval,
-		})
-		l.Bind(conn)
-		defer l.Close()
-		for _, t := range client.tunnels {
-			proto, localHost, localPort, remoteHost, remotePort, reverse, err := parseTunnel(t)
-			if err != nil {
-				logrus.Fatalf("parse tunnel failed: %s", err)
-			}
-			l.OpenTunnel(proto, localHost, localPort, remoteHost, remotePort, reverse)
+		delay, err := b.Next()
+		if err != nil {
+			logrus.Errorf("reconnect to %s failed %d times: %s", client.addr, b.Attempts()-1, err)
+			return err
 		}
-
-		l.Wait()
-		time.Sleep(1 * time.Second) // TODO: sleep smartly
+		logrus.WithFields(logrus.Fields{
+			"attempt": b.Attempts(),
+			"delay":   delay,
+			"next":    time.Now().Add(delay).Format("01/02 15:04:05.000"),
+		}).Warnf("reconnect to %s later", client.addr)
+		time.Sleep(delay)
 	}
-
 }
 
-func parseTunnel(value string) (proto string, localHost string, localPort int, remoteHost string, remotePort int, reverse bool, err error) {
-	L := strings.Split(value, ":")
-
-	// !IMPORTANT! support old configure
-	if len(L) == 5 {
-		L = append([]string{L[0], "tcp"}, L[1:]...)
-	}
-
-	if len(L) != 6 {
-		fmt.Println("tunnel format: \"r|f:proto:local_host:local_port:remote_host:remote_port\"")
-		err = errors.New("tunnel map is wrong: " + value)
+// serve run the link on conn until it is broken, the link is kept for
+// resuming if server supports it
+func (client *Client) serve(conn es.Conn, hs *handshakeResult) {
+	if hs.resumed {
+		if err := client.link.Resume(conn, hs.peerRecv); err != nil {
+			logrus.Errorf("resume link %d failed: %s", client.linkID, err)
+			conn.Close()
+			client.closeLink()
+			return
+		}
+		logrus.Infof("link %d is resumed", client.linkID)
+		client.link.Wait()
 		return
 	}
 
-	switch L[0] {
-	case "r", "R":
-		reverse = true
-	case "f", "F":
-		reverse = false
-	default:
-		err = errors.New("wrong tunnel map")
-		return
+	// the old link can not be resumed
+	client.closeLink()
+
+	l := link.NewLink(&link.LinkConfig{
+		IsServerSide:      false,
+		KeepaliveInterval: client.keepaliveInterval,
+		Resumable:         hs.token != "",
+		ReadLimiter: ratelimit.Limiter{
+			ratelimit.NewBucket(client.uploadLimit, client.limitBurst),
+			// the upload limit of server
+			ratelimit.NewBucket(hs.uploadLimit, hs.limitBurst),
+		},
+		Routes:         client.p2pRoutes(),
+		DialOptions:    client.dialOptions,
+		LegacyChannels: !hs.channelOpen,
+	})
+	client.setLink(l)
+	client.linkID = hs.linkID
+	client.resumeToken = hs.token
+
+	l.Bind(conn)
+	if client.peer == "" {
+		client.openTunnels(l)
 	}
 
-	proto = strings.TrimSpace(strings.ToLower(L[1]))
-	if proto == "" {
-		proto = "tcp"
+	l.Wait()
+	if client.resumeToken == "" {
+		client.closeLink()
 	}
-	if !(proto == "tcp" || proto == "udp") {
-		err = errors.New("unknown protocol")
-		return
-	}
-	localHost = L[2]
-	remoteHost = L[4]
-	localPort, err = strconv.Atoi(L[3])
-	if err != nil {
-		return
-	}
-	remotePort, err = strconv.Atoi(L[5])
-	if err != nil {
+}
+
+func (client *Client) closeLink() {
+	if client.link == nil {
 		return
 	}
+	client.link.Close()
+	client.setLink(nil)
+	client.linkID = 0
+	client.resumeToken = ""
+}
+
+// setLink save the link to server, it is read by servePeer
+func (client *Client) setLink(l *link.Link) {
+	client.linkMutex.Lock()
+	client.link = l
+	client.linkMutex.Unlock()
+}
 
-	return
+func (client *Client) currentLink() *link.Link {
+	client.linkMutex.Lock()
+	defer client.linkMutex.Unlock()
+	return client.link
 }
@@ -1,14 +1,18 @@
 package client
 
 import (
+	"os"
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 // Command run connect command
 var Command = cli.Command{
-	Name:  "connect",
-	Usage: "connect to a server",
+	Name:      "connect",
+	Usage:     "connect to a server",
+	ArgsUsage: "host:port | srv:_otunnel._tcp.example.com",
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "d, debug",
@@ -23,6 +27,22 @@ var Command = cli.Command{
 			Name:  "s, secret",
 			Usage: "secret phrase",
 		},
+		cli.BoolFlag{
+			Name:  "tls",
+			Usage: "connect to a TLS server",
+		},
+		cli.StringFlag{
+			Name:  "fingerprint",
+			Usage: "the expected server certificate fingerprint, such as sha256:6b86b2..., implies --tls",
+		},
+		cli.BoolFlag{
+			Name:  "srv-fingerprint",
+			Usage: "read the expected server certificate fingerprints from the TXT records of the srv: name, implies --tls",
+		},
+		cli.StringFlag{
+			Name:  "dns",
+			Usage: "resolve the srv: server address by this DNS server, such as 127.0.0.1:53, instead of the system resolver",
+		},
 		cli.IntFlag{
 			Name:  "keyiter",
 			Usage: "key iter times for pbkdf2",
@@ -40,6 +60,96 @@ var Command = cli.Command{
 			Value: 30,
 			Usage: "keepalive interval",
 		},
+		cli.BoolTFlag{
+			Name:  "resume",
+			Usage: "resume the link after a brief disconnect if server supports it, use --resume=false to disable",
+		},
+		cli.DurationFlag{
+			Name:  "dial-timeout",
+			Value: 10 * time.Second,
+			Usage: "timeout of connecting to the server",
+		},
+		cli.DurationFlag{
+			Name:  "handshake-timeout",
+			Value: 10 * time.Second,
+			Usage: "timeout of the handshake after connected",
+		},
+		cli.DurationFlag{
+			Name:  "retry-min",
+			Value: 1 * time.Second,
+			Usage: "the first reconnect delay",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max",
+			Value: 60 * time.Second,
+			Usage: "the max reconnect delay",
+		},
+		cli.Float64Flag{
+			Name:  "retry-factor",
+			Value: 2,
+			Usage: "the reconnect delay grows by this factor after every failure",
+		},
+		cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "exit after this many reconnect failures in a row, 0 means retry forever",
+		},
+		cli.DurationFlag{
+			Name:  "max-retry-duration",
+			Usage: "exit if can not reconnect in this duration, 0 means retry forever",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "register this client in server with the name, the clients with --peer NAME and the same --peer-secret can open tunnels to it",
+		},
+		cli.StringFlag{
+			Name:  "peer",
+			Usage: "open the tunnels to the client registered with this name, directly by UDP hole punching if possible, or relayed by server",
+		},
+		cli.StringFlag{
+			Name:  "peer-secret",
+			Usage: "the secret of P2P, a client with --name accepts only the peers with the same secret",
+		},
+		cli.StringFlag{
+			Name:  "upload-limit",
+			Usage: "max upload bytes per second of all tunnels, such as 512K or 10M",
+		},
+		cli.StringFlag{
+			Name:  "download-limit",
+			Usage: "max download bytes per second of all tunnels, such as 512K or 10M",
+		},
+		cli.StringFlag{
+			Name:  "limit-burst",
+			Usage: "the burst size of the rate limits, default to one second of the rate",
+		},
+		cli.StringFlag{
+			Name:  "bind",
+			Usage: "the source address of the connections to server and to the tunnel targets, such as 192.168.1.2",
+		},
+		cli.StringFlag{
+			Name:  "nodelay",
+			Usage: "TCP_NODELAY of the outgoing connections, true (default) or false",
+		},
+		cli.StringFlag{
+			Name:  "tcp-keepalive",
+			Usage: "the TCP keepalive period of the outgoing connections, such as 30s, or off (default 15s)",
+		},
+		cli.StringFlag{
+			Name:  "user-timeout",
+			Usage: "TCP_USER_TIMEOUT of the outgoing connections, such as 30s (linux only)",
+		},
+		cli.StringFlag{
+			Name:  "mark",
+			Usage: "SO_MARK (fwmark) of the outgoing connections for policy routing (linux only)",
+		},
+		cli.StringFlag{
+			Name:  "status-file",
+			Usage: "write the state and stats of the link and tunnels to the file in JSON, such as the remote ports assigned by server",
+		},
+		cli.DurationFlag{
+			Name:  "status-interval",
+			Value: 10 * time.Second,
+			Usage: "the interval of writing the status file",
+		},
 	},
 	Action: func(c *cli.Context) {
 		if c.Bool("debug") {
@@ -51,6 +161,9 @@ var Command = cli.Command{
 			logrus.Errorf("connect to server failed: %s", err)
 			return
 		}
-		_client.Start()
+		if err := _client.Start(); err != nil {
+			logrus.Errorf("client quit: %s", err)
+			os.Exit(1)
+		}
 	},
 }
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/otunnel/pkg/util"
+)
+
+const (
+	// srvPrefix is the prefix of the server address to discover the
+	// servers by DNS SRV records, such as srv:_otunnel._tcp.example.com
+	srvPrefix = "srv:"
+
+	// fingerprintPrefix is the prefix of the TXT records of the SRV name
+	// which give the expected server certificate fingerprints
+	fingerprintPrefix = "fingerprint="
+)
+
+var errNoServer = errors.New("no server in the SRV records")
+
+// server is an address to connect, with the fingerprints its certificate
+// must match, no fingerprint means the certificate is not pinned
+type server struct {
+	addr         string
+	fingerprints []string
+}
+
+// newResolver return the resolver of the DNS server addr, such as
+// 127.0.0.1:5353, or the system resolver if addr is empty
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// servers return the servers to try in order. A srv: address is resolved
+// every time, so the clients follow the records when servers move.
+func (client *Client) servers() ([]server, error) {
+	if !strings.HasPrefix(client.addr, srvPrefix) {
+		return []server{{addr: client.addr, fingerprints: client.fingerprints}}, nil
+	}
+	name := strings.TrimPrefix(client.addr, srvPrefix)
+
+	ctx := context.Background()
+	if client.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.dialTimeout)
+		defer cancel()
+	}
+
+	// the records are sorted by priority, and randomized by weight in the
+	// same priority, as RFC 2782
+	_, records, err := client.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		// the records of invalid names are dropped, use the others
+		if len(records) == 0 {
+			return nil, err
+		}
+		logrus.Warnf("SRV %s: %s", name, err)
+	}
+
+	fingerprints := client.fingerprints
+	if client.srvFingerprint {
+		if fingerprints, err = lookupFingerprints(ctx, client.resolver, name); err != nil {
+			return nil, err
+		}
+	}
+
+	servers := []server{}
+	for _, r := range records {
+		// "." means the service is not available
+		host := strings.TrimSuffix(r.Target, ".")
+		if host == "" {
+			continue
+		}
+		servers = append(servers, server{
+			addr:         net.JoinHostPort(host, strconv.Itoa(int(r.Port))),
+			fingerprints: fingerprints,
+		})
+	}
+	if len(servers) == 0 {
+		return nil, errNoServer
+	}
+	logrus.Debugf("SRV %s: %d servers, the first is %s", name, len(servers), servers[0].addr)
+	return servers, nil
+}
+
+// lookupFingerprints return the fingerprints in the TXT records of name,
+// such as "fingerprint=sha256:6b86b2...", many records are allowed for
+// the servers of different certificates or rotating a certificate
+func lookupFingerprints(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup fingerprints: %s", err)
+	}
+	fingerprints := []string{}
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, fingerprintPrefix) {
+			continue
+		}
+		fp, err := util.ParseFingerprint(strings.TrimPrefix(txt, fingerprintPrefix))
+		if err != nil {
+			logrus.Warnf("TXT %s: ignore %q: %s", name, txt, err)
+			continue
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("no fingerprint in the TXT records of %s", name)
+	}
+	return fingerprints, nil
+}
+
+// preferServer move the server at addr to the front, if it is in servers
+func preferServer(servers []server, addr string) []server {
+	for i, s := range servers {
+		if s.addr == addr {
+			sorted := append([]server{s}, servers[:i]...)
+			return append(sorted, servers[i+1:]...)
+		}
+	}
+	return servers
+}
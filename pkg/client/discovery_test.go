@@ -0,0 +1,217 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooclab/otunnel/pkg/util"
+)
+
+const (
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+)
+
+// stubDNS is a DNS server of the SRV and TXT records by name
+type stubDNS struct {
+	srv map[string][]net.SRV
+	txt map[string][]string
+}
+
+// serve answer the queries on a loopback UDP port, return its address
+func (d *stubDNS) serve(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := d.answer(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+// answer build the response of a query with one question
+func (d *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	labels := []string{}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		n := int(query[i])
+		if i+1+n > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	answers := [][]byte{}
+	switch qtype {
+	case dnsTypeSRV:
+		for _, r := range d.srv[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata, r.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], r.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], r.Port)
+			answers = append(answers, append(rdata, encodeDNSName(r.Target)...))
+		}
+	case dnsTypeTXT:
+		for _, txt := range d.txt[name] {
+			answers = append(answers, append([]byte{byte(len(txt))}, txt...))
+		}
+	}
+
+	resp := make([]byte, 12)
+	copy(resp, query[:2])
+	flags := uint16(0x8180) // response, recursion desired and available
+	if d.srv[name] == nil && d.txt[name] == nil {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, rdata := range answers {
+		rr := make([]byte, 12)
+		binary.BigEndian.PutUint16(rr, 0xc00c) // the name of the question
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint16(rr[4:], 1)
+		binary.BigEndian.PutUint32(rr[6:], 60)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		resp = append(append(resp, rr...), rdata...)
+	}
+	return resp
+}
+
+func encodeDNSName(name string) []byte {
+	b := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			b = append(append(b, byte(len(label))), label...)
+		}
+	}
+	return append(b, 0)
+}
+
+const testFingerprint = "sha256:6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"
+
+func newTestDiscovery(t *testing.T) *Client {
+	d := &stubDNS{
+		srv: map[string][]net.SRV{
+			"_otunnel._tcp.example.com": {
+				{Target: "c.example.com.", Port: 1000, Priority: 20},
+				{Target: ".", Port: 0, Priority: 5},
+				{Target: "a.example.com.", Port: 1001, Priority: 10, Weight: 10},
+				{Target: "b.example.com.", Port: 1002, Priority: 10, Weight: 10},
+			},
+			"_down._tcp.example.com": {
+				{Target: ".", Port: 0},
+			},
+		},
+		txt: map[string][]string{
+			"_otunnel._tcp.example.com": {
+				"v=spf1 -all",
+				"fingerprint=bad",
+				"fingerprint=SHA256:" + strings.ToUpper(strings.TrimPrefix(testFingerprint, "sha256:")),
+			},
+			"_down._tcp.example.com": {"v=spf1 -all"},
+		},
+	}
+	return &Client{resolver: newResolver(d.serve(t)), dialTimeout: 2 * time.Second}
+}
+
+func Test_Client_servers(t *testing.T) {
+	client := newTestDiscovery(t)
+	client.addr = "srv:_otunnel._tcp.example.com"
+	client.fingerprints = []string{"sha256:flag"}
+
+	for i := 0; i < 5; i++ {
+		servers, err := client.servers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := []string{}
+		for _, s := range servers {
+			addrs = append(addrs, s.addr)
+			if len(s.fingerprints) != 1 || s.fingerprints[0] != "sha256:flag" {
+				t.Errorf("%s has fingerprints %v, expect the flag", s.addr, s.fingerprints)
+			}
+		}
+		// the same priority in any order, "." is skipped
+		if len(addrs) != 3 || addrs[2] != "c.example.com:1000" ||
+			!(addrs[0] == "a.example.com:1001" && addrs[1] == "b.example.com:1002" ||
+				addrs[0] == "b.example.com:1002" && addrs[1] == "a.example.com:1001") {
+			t.Fatalf("bad order of servers: %v", addrs)
+		}
+	}
+
+	client.srvFingerprint = true
+	servers, err := client.servers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fps := servers[0].fingerprints; len(fps) != 1 || fps[0] != testFingerprint {
+		t.Errorf("got fingerprints %v from TXT, expect %s", fps, testFingerprint)
+	}
+
+	client.addr = "srv:_down._tcp.example.com"
+	client.srvFingerprint = false
+	if _, err := client.servers(); err != errNoServer {
+		t.Errorf("got %v for a service not available, expect %v", err, errNoServer)
+	}
+	client.srvFingerprint = true
+	if _, err := client.servers(); err == nil {
+		t.Error("the TXT records without fingerprint should fail")
+	}
+	client.addr = "srv:_none._tcp.example.com"
+	if _, err := client.servers(); err == nil {
+		t.Error("a name without SRV records should fail")
+	}
+
+	client.addr = "127.0.0.1:10000"
+	if servers, err := client.servers(); err != nil || len(servers) != 1 || servers[0].addr != client.addr {
+		t.Errorf("got %v, %v for a plain address", servers, err)
+	}
+}
+
+func Test_verifyFingerprint(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+	fp := util.CertFingerprint(ts.Certificate().Raw)
+
+	conn, err := StartTLSConnect(addr, "", "", "", 2*time.Second, nil, []string{testFingerprint, fp})
+	if err != nil {
+		t.Fatalf("the pinned certificate is rejected: %s", err)
+	}
+	conn.Close()
+
+	if _, err := StartTLSConnect(addr, "", "", "", 2*time.Second, nil, []string{testFingerprint}); err == nil || !strings.Contains(err.Error(), fp) {
+		t.Errorf("got %v for a certificate not pinned, expect a mismatch of %s", err, fp)
+	}
+	if err := verifyFingerprint([]string{fp})(nil, nil); err == nil {
+		t.Error("a server without certificate should fail")
+	}
+}
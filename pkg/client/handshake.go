@@ -2,39 +2,73 @@ package client
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/ooclab/es"
 	pjson "github.com/ooclab/otunnel/pkg/proto/json"
 )
 
-func handshake(conn es.Conn) error {
-	jconn := pjson.NewConn(conn)
+// handshakeResult is the link info returned by server
+type handshakeResult struct {
+	linkID uint32
 
-	if err := clientAuth(jconn); err != nil {
-		return err
-	}
+	// token is empty if the server does not support resuming
+	token string
+
+	// resumed is true if the server resumed the link we asked for
+	resumed bool
+
+	// peerRecv is the frames count server received in the resumed link
+	peerRecv uint64
 
-	return nil
+	// the upload limit of server for every client, 0 means no limit
+	uploadLimit int64
+	limitBurst  int64
+
+	// channelOpen is true if the server answers the opens of channels
+	channelOpen bool
 }
 
-func clientAuth(c *pjson.Conn) error {
-	resp, err := c.Request(map[string]interface{}{
-		"action": "new",
-	})
+func handshake(conn es.Conn, req map[string]interface{}) (*handshakeResult, error) {
+	jconn := pjson.NewConn(conn)
+
+	return clientAuth(jconn, req)
+}
+
+func clientAuth(c *pjson.Conn, req map[string]interface{}) (*handshakeResult, error) {
+	resp, err := c.Request(req)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if e, ok := resp["error"].(string); ok {
+		return nil, fmt.Errorf("server refused: %s", e)
 	}
 
 	// fmt.Printf("got resp: %+v\n", resp)
 
-	_, ok := resp["link_id"]
+	linkID, ok := resp["link_id"].(float64)
 	// fmt.Println(linkID, ok)
 	if !ok {
-		return errors.New("can not find link_id in sayhi response")
+		return nil, errors.New("can not find link_id in sayhi response")
 	}
 
-	// log.Debugf("got link %d", uint64(linkID.(float64)))
-	// fmt.Println("linkID = ", linkID)
+	r := &handshakeResult{linkID: uint32(linkID)}
+	r.token, _ = resp["resume_token"].(string)
+	r.resumed, _ = resp["resumed"].(bool)
+	r.channelOpen, _ = resp["channel_open"].(bool)
+	if v, ok := resp["upload_limit"].(float64); ok {
+		r.uploadLimit = int64(v)
+	}
+	if v, ok := resp["limit_burst"].(float64); ok {
+		r.limitBurst = int64(v)
+	}
+	if r.resumed {
+		recv, ok := resp["recv"].(float64)
+		if !ok {
+			return nil, errors.New("can not find recv in resume response")
+		}
+		r.peerRecv = uint64(recv)
+	}
 
-	return nil
+	return r, nil
 }
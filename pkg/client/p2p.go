@@ -0,0 +1,288 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/proto/udp"
+	"github.com/ooclab/es/ratelimit"
+	"github.com/ooclab/es/session"
+	"github.com/ooclab/otunnel/pkg/p2p"
+	pjson "github.com/ooclab/otunnel/pkg/proto/json"
+)
+
+// peerRetryDelay is the delay before connecting the peer again
+const peerRetryDelay = 5 * time.Second
+
+var errEndpointTimeout = errors.New("wait the endpoint of peer timeout")
+
+// peerConn is a link conn over proto/udp, closing it closes the socket
+type peerConn struct {
+	*udp.Conn
+	sock interface {
+		Close() error
+	}
+	uconn *net.UDPConn
+}
+
+func (c *peerConn) Close() error {
+	c.Conn.Close()
+	c.sock.Close()
+	return c.uconn.Close()
+}
+
+// p2pRoutes return the session request handlers of the link to server
+func (client *Client) p2pRoutes() []session.Route {
+	return []session.Route{
+		{Action: p2p.ActionOffer, Handler: client.handleOffer},
+		{Action: p2p.ActionEndpoint, Handler: client.handleEndpoint},
+	}
+}
+
+// handleOffer accept a peer connecting to this client
+func (client *Client) handleOffer(r *session.Request) (*session.Response, error) {
+	if client.name == "" {
+		return &session.Response{Status: "not-acceptable"}, nil
+	}
+	offer := &p2p.Offer{}
+	if err := json.Unmarshal(r.Body, offer); err != nil {
+		return &session.Response{Status: "load-offer-error"}, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(offer.Secret), []byte(client.peerSecret)) != 1 {
+		logrus.Warnf("p2p session %d: refuse the peer, wrong secret", offer.ID)
+		return &session.Response{Status: "wrong-peer-secret"}, nil
+	}
+
+	// !IMPORTANT! the endpoint may come just after the response
+	endpoint := client.waitEndpoint(offer.ID)
+	go func() {
+		defer client.forgetEndpoint(offer.ID)
+		l, err := client.peerLink(offer, endpoint, false)
+		if err != nil {
+			logrus.Errorf("p2p session %d: accept peer failed: %s", offer.ID, err)
+			return
+		}
+		l.Wait()
+		l.Close()
+		logrus.Warnf("p2p session %d: the link of peer is closed", offer.ID)
+	}()
+	return &session.Response{Status: "success"}, nil
+}
+
+func (client *Client) handleEndpoint(r *session.Request) (*session.Response, error) {
+	endpoint := &p2p.Endpoint{}
+	if err := json.Unmarshal(r.Body, endpoint); err != nil {
+		return &session.Response{Status: "load-endpoint-error"}, nil
+	}
+	client.p2pMutex.Lock()
+	ch := client.p2pWaits[endpoint.ID]
+	client.p2pMutex.Unlock()
+	if ch == nil {
+		return &session.Response{Status: "p2p-session-not-found"}, nil
+	}
+	select {
+	case ch <- endpoint.Addr:
+	default:
+	}
+	return &session.Response{Status: "success"}, nil
+}
+
+func (client *Client) waitEndpoint(id uint32) chan string {
+	ch := make(chan string, 1)
+	client.p2pMutex.Lock()
+	client.p2pWaits[id] = ch
+	client.p2pMutex.Unlock()
+	return ch
+}
+
+func (client *Client) forgetEndpoint(id uint32) {
+	client.p2pMutex.Lock()
+	delete(client.p2pWaits, id)
+	client.p2pMutex.Unlock()
+}
+
+// servePeer keep a link to the peer and the tunnels on it
+func (client *Client) servePeer() {
+	for {
+		l := client.currentLink()
+		if l == nil || l.IsClosed() {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		pl, err := client.connectPeer(l)
+		if err != nil {
+			logrus.Errorf("connect peer %s failed: %s", client.peer, err)
+			time.Sleep(peerRetryDelay)
+			continue
+		}
+		client.openTunnels(pl)
+		pl.Wait()
+		pl.Close()
+		logrus.Warnf("the link to peer %s is closed", client.peer)
+		time.Sleep(peerRetryDelay)
+	}
+}
+
+// connectPeer ask server to connect the peer, return the link to peer
+func (client *Client) connectPeer(l *link.Link) (*link.Link, error) {
+	s, err := l.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(p2p.ConnectRequest{Peer: client.peer, Secret: client.peerSecret})
+	resp, err := s.SendAndWait(&session.Request{Action: p2p.ActionConnect, Body: body})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, errors.New(resp.Status)
+	}
+	offer := &p2p.Offer{}
+	if err := json.Unmarshal(resp.Body, offer); err != nil {
+		return nil, err
+	}
+
+	endpoint := client.waitEndpoint(offer.ID)
+	defer client.forgetEndpoint(offer.ID)
+	return client.peerLink(offer, endpoint, true)
+}
+
+// peerLink create the link to peer, over a punched UDP path if possible,
+// or relayed by server. The dialer is the client side of the link.
+func (client *Client) peerLink(offer *p2p.Offer, endpoint chan string, dial bool) (*link.Link, error) {
+	conn, err := client.punch(offer, endpoint, dial)
+	if err != nil {
+		logrus.Warnf("p2p session %d: punch failed, relay by server: %s", offer.ID, err)
+		if conn, err = client.connectRelay(offer); err != nil {
+			return nil, err
+		}
+	}
+
+	l := link.NewLink(&link.LinkConfig{
+		IsServerSide:      !dial,
+		KeepaliveInterval: client.keepaliveInterval,
+		ReadLimiter: ratelimit.Limiter{
+			ratelimit.NewBucket(client.uploadLimit, client.limitBurst),
+		},
+		DialOptions:    client.dialOptions,
+		LegacyChannels: !offer.ChannelOpen,
+	})
+	l.Bind(conn)
+	return l, nil
+}
+
+// punch probe server for the endpoint of peer, and then handshake over
+// proto/udp: the dialer send SYNs to peer, the acceptor send punches to
+// open its NAT for the SYNs
+func (client *Client) punch(offer *p2p.Offer, endpoint chan string, dial bool) (es.Conn, error) {
+	saddr, err := net.ResolveUDPAddr("udp", client.currentServer().addr)
+	if err != nil {
+		return nil, err
+	}
+	uconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	raddr, err := probe(uconn, saddr, offer.Token, endpoint)
+	if err != nil {
+		uconn.Close()
+		return nil, err
+	}
+	logrus.Debugf("p2p session %d: punch %s from %s", offer.ID, raddr, uconn.LocalAddr())
+
+	if dial {
+		sock, c, err := udp.DialSocket(uconn, raddr, offer.Key, p2p.PunchInterval, p2p.PunchTimeout)
+		if err != nil {
+			uconn.Close()
+			return nil, err
+		}
+		logrus.Infof("p2p session %d: connect peer %s directly", offer.ID, raddr)
+		return &peerConn{Conn: c, sock: sock, uconn: uconn}, nil
+	}
+
+	sock, err := udp.NewServerSocket(uconn, offer.Key)
+	if err != nil {
+		uconn.Close()
+		return nil, err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			uconn.WriteToUDP(p2p.Punch, raddr)
+			select {
+			case <-stop:
+				return
+			case <-time.After(p2p.PunchInterval):
+			}
+		}
+	}()
+	// the dialer may give up, wait a bit more than it
+	timer := time.AfterFunc(p2p.PunchTimeout+2*time.Second, func() { sock.Close() })
+	c, err := sock.Accept()
+	timer.Stop()
+	if err != nil {
+		sock.Close()
+		uconn.Close()
+		return nil, err
+	}
+	logrus.Infof("p2p session %d: accept peer %s directly", offer.ID, c.RemoteAddr())
+	return &peerConn{Conn: c, sock: sock, uconn: uconn}, nil
+}
+
+// probe send the probe to server until the endpoint of peer is known
+func probe(uconn *net.UDPConn, saddr *net.UDPAddr, token string, endpoint chan string) (*net.UDPAddr, error) {
+	ticker := time.NewTicker(p2p.ProbeInterval)
+	defer ticker.Stop()
+	timeout := time.After(p2p.EndpointTimeout)
+	for {
+		if _, err := uconn.WriteToUDP(p2p.Probe(token), saddr); err != nil {
+			return nil, err
+		}
+		select {
+		case addr := <-endpoint:
+			return net.ResolveUDPAddr("udp", addr)
+		case <-ticker.C:
+		case <-timeout:
+			return nil, errEndpointTimeout
+		}
+	}
+}
+
+// connectRelay connect to server, and wait it relay the conn to peer
+func (client *Client) connectRelay(offer *p2p.Offer) (es.Conn, error) {
+	rawConn, conn, err := client.dialServer(client.currentServer())
+	if err != nil {
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Now().Add(p2p.RelayTimeout + client.handshakeTimeout))
+
+	resp, err := pjson.NewConn(conn).Request(map[string]interface{}{
+		"action": "relay",
+		"token":  offer.Token,
+	})
+	if err == nil {
+		if e, ok := resp["error"].(string); ok {
+			err = fmt.Errorf("relay failed: %s", e)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Important! cancel timeout!
+	rawConn.SetDeadline(time.Time{})
+	logrus.Infof("p2p session %d: the link to peer is relayed by server", offer.ID)
+	return conn, nil
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ooclab/es/session"
+	"github.com/ooclab/otunnel/pkg/p2p"
+)
+
+func Test_Client_handleOffer(t *testing.T) {
+	client := &Client{
+		name:       "alice",
+		peerSecret: "s3cr3t",
+		server:     server{addr: "no-port"},
+		p2pWaits:   map[uint32]chan string{},
+	}
+	offer := func(id uint32, secret string) string {
+		body, _ := json.Marshal(p2p.Offer{ID: id, Secret: secret})
+		resp, err := client.handleOffer(&session.Request{Action: p2p.ActionOffer, Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+
+	for _, secret := range []string{"", "bad", "s3cr3t "} {
+		if status := offer(1, secret); status != "wrong-peer-secret" {
+			t.Errorf("got %s for the secret %q, expect wrong-peer-secret", status, secret)
+		}
+	}
+	client.p2pMutex.Lock()
+	if len(client.p2pWaits) != 0 {
+		t.Error("a refused peer waits the endpoint")
+	}
+	client.p2pMutex.Unlock()
+
+	// the peer link fails at once without a server
+	if status := offer(2, "s3cr3t"); status != "success" {
+		t.Errorf("got %s for the right secret, expect success", status)
+	}
+
+	client.name = ""
+	if status := offer(3, "s3cr3t"); status != "not-acceptable" {
+		t.Errorf("got %s for a client without name, expect not-acceptable", status)
+	}
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/otunnel/pkg/spec"
+)
+
+// tunnelStatus is the state of a tunnel of the -t options
+type tunnelStatus struct {
+	Spec string `json:"spec"`
+	Open bool   `json:"open"`
+	// ID is the tunnel ID on the link, 0 if it is not open
+	ID uint32 `json:"id,omitempty"`
+	// RemotePort is the port assigned by server for remote port 0, it is
+	// asked for again after reconnecting
+	RemotePort int    `json:"remote_port,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// Stats is the stats of the open tunnel
+	Stats *tunnel.Stats `json:"stats,omitempty"`
+}
+
+// status is the content of the status file
+type status struct {
+	Time      time.Time      `json:"time"`
+	Server    string         `json:"server"`
+	Link      uint32         `json:"link,omitempty"`
+	Connected bool           `json:"connected"`
+	Tunnels   []tunnelStatus `json:"tunnels"`
+}
+
+func newTunnelStatuses(specs []*spec.Spec) []*tunnelStatus {
+	statuses := make([]*tunnelStatus, len(specs))
+	for i, s := range specs {
+		statuses[i] = &tunnelStatus{Spec: s.String()}
+	}
+	return statuses
+}
+
+// openTunnels open all tunnels on link l. The remote ports assigned last
+// time are asked for before any new port is assigned, so a tunnel does not
+// take the old port of another one.
+func (client *Client) openTunnels(l *link.Link) {
+	var rest []int
+	for i, s := range client.tunnels {
+		client.statusMutex.Lock()
+		assigned := client.statuses[i].RemotePort
+		client.statusMutex.Unlock()
+		if !s.AssignPort() || assigned == 0 {
+			rest = append(rest, i)
+			continue
+		}
+
+		cfg := s.TunnelConfig()
+		cfg.RemotePort = assigned
+		if err := l.OpenTunnelWithConfig(cfg); err != nil {
+			logrus.Warnf("tunnel %s: the remote port %d is not available again: %s", s, assigned, err)
+			rest = append(rest, i)
+			continue
+		}
+		client.tunnelOpened(i, cfg, nil)
+	}
+	for _, i := range rest {
+		cfg := client.tunnels[i].TunnelConfig()
+		client.tunnelOpened(i, cfg, l.OpenTunnelWithConfig(cfg))
+	}
+	client.setTunnelLink(l)
+	client.writeStatus()
+}
+
+// tunnelOpened record the result of opening the i-th tunnel
+func (client *Client) tunnelOpened(i int, cfg *tunnel.TunnelConfig, err error) {
+	s, st := client.tunnels[i], client.statuses[i]
+
+	client.statusMutex.Lock()
+	st.Open, st.ID, st.Error = err == nil, 0, ""
+	if err != nil {
+		st.Error = err.Error()
+	} else {
+		st.ID = cfg.ID
+		if s.AssignPort() {
+			st.RemotePort = cfg.RemotePort
+		}
+	}
+	client.statusMutex.Unlock()
+
+	if err != nil {
+		logrus.Errorf("open tunnel %s failed: %s", s, err)
+		return
+	}
+	logrus.Infof("open tunnel %s success", s)
+	if s.AssignPort() {
+		logrus.Infof("tunnel %s: the remote port is %d", s, cfg.RemotePort)
+	}
+}
+
+// setTunnelLink save the link which the tunnels are opened on, it is the
+// link to server or to the peer
+func (client *Client) setTunnelLink(l *link.Link) {
+	client.statusMutex.Lock()
+	client.tunnelLink = l
+	client.statusMutex.Unlock()
+}
+
+// status return the snapshot of the link and the tunnels
+func (client *Client) status() *status {
+	client.statusMutex.Lock()
+	defer client.statusMutex.Unlock()
+
+	st := &status{
+		Time:   time.Now(),
+		Server: client.currentServer().addr,
+		Link:   client.linkID,
+	}
+	l := client.tunnelLink
+	st.Connected = l != nil && !l.IsClosed()
+	stats := map[uint32]tunnel.Stats{}
+	if st.Connected {
+		for _, s := range l.TunnelStats() {
+			stats[s.ID] = s
+		}
+	}
+	for _, ts := range client.statuses {
+		v := *ts
+		v.Open = v.Open && st.Connected
+		if s, ok := stats[v.ID]; ok && v.Open {
+			v.Stats = &s
+		}
+		st.Tunnels = append(st.Tunnels, v)
+	}
+	return st
+}
+
+// writeStatus write the status file, it is replaced at once so a reader
+// never sees a partial file
+func (client *Client) writeStatus() {
+	if client.statusFile == "" {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(client.statusFile), ".otunnel-status-")
+	if err != nil {
+		logrus.Errorf("write status file failed: %s", err)
+		return
+	}
+	enc := json.NewEncoder(tmp)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(client.status())
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), client.statusFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logrus.Errorf("write status file failed: %s", err)
+	}
+}
+
+// serveStatus write the status file periodically
+func (client *Client) serveStatus() {
+	for {
+		client.writeStatus()
+		time.Sleep(client.statusInterval)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/otunnel/pkg/spec"
+)
+
+// newTestStatus return a client of the tunnel specs, its status file is in
+// a temporary directory
+func newTestStatus(t *testing.T, specs ...string) *Client {
+	client := &Client{statusFile: filepath.Join(t.TempDir(), "status.json")}
+	for _, s := range specs {
+		sp, err := spec.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.tunnels = append(client.tunnels, sp)
+	}
+	client.statuses = newTunnelStatuses(client.tunnels)
+	return client
+}
+
+// readStatus load the status file, it must be the only file in its
+// directory
+func readStatus(t *testing.T, client *Client) *status {
+	files, err := os.ReadDir(filepath.Dir(client.statusFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files, the temporary file is left", len(files))
+	}
+	data, err := os.ReadFile(client.statusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &status{}
+	if err := json.Unmarshal(data, st); err != nil {
+		t.Fatalf("bad status file: %s", err)
+	}
+	return st
+}
+
+// newTestLinks return the links of a client and a server over a pipe, the
+// server assigns the ports of pool
+func newTestLinks(pool *tunnel.PortPool) (*link.Link, *link.Link) {
+	c, s := net.Pipe()
+	server := link.NewLink(&link.LinkConfig{IsServerSide: true, PortPool: pool})
+	client := link.NewLink(nil)
+	go server.Bind(es.NewBaseConn(s))
+	client.Bind(es.NewBaseConn(c))
+	return client, server
+}
+
+// freePortPool return a pool of n ports which can be listened now
+func freePortPool(t *testing.T, n int) *tunnel.PortPool {
+	for i := 0; i < 20; i++ {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		free := first+n-1 <= 65535
+		for port := first; free && port < first+n; port++ {
+			l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				free = false
+				break
+			}
+			l.Close()
+		}
+		if free {
+			return tunnel.NewPortPool(first, first+n-1)
+		}
+	}
+	t.Fatalf("no %d free ports in a row", n)
+	return nil
+}
+
+func Test_Client_writeStatus(t *testing.T) {
+	client := newTestStatus(t,
+		"r+tcp://127.0.0.1:22?remote=:0",
+		"r+tcp://127.0.0.1:80?remote=:8080",
+	)
+	client.server = server{addr: "127.0.0.1:10000"}
+	client.tunnelOpened(0, &tunnel.TunnelConfig{ID: 3, RemotePort: 40001}, nil)
+	client.tunnelOpened(1, nil, fmt.Errorf("listen failed"))
+	client.writeStatus()
+
+	st := readStatus(t, client)
+	if st.Server != "127.0.0.1:10000" || st.Connected {
+		t.Errorf("bad status of the link: %+v", st)
+	}
+	if len(st.Tunnels) != 2 {
+		t.Fatalf("got %d tunnels, expect 2", len(st.Tunnels))
+	}
+	// the tunnels are not open without a link, the port is kept
+	if ts := st.Tunnels[0]; ts.Spec != "r+tcp://127.0.0.1:22?remote=:0" || ts.Open || ts.RemotePort != 40001 || ts.Error != "" {
+		t.Errorf("bad status of the assigned tunnel: %+v", ts)
+	}
+	if ts := st.Tunnels[1]; ts.Open || ts.RemotePort != 0 || ts.Error != "listen failed" {
+		t.Errorf("bad status of the failed tunnel: %+v", ts)
+	}
+
+	// the file is replaced
+	client.tunnelOpened(1, &tunnel.TunnelConfig{ID: 4, RemotePort: 8080}, nil)
+	client.writeStatus()
+	if ts := readStatus(t, client).Tunnels[1]; ts.Error != "" || ts.RemotePort != 0 {
+		t.Errorf("bad status of the tunnel opened again: %+v", ts)
+	}
+
+	client.statusFile = filepath.Join(client.statusFile, "none", "status.json")
+	client.writeStatus()
+}
+
+func Test_Client_openTunnels_Reconnect(t *testing.T) {
+	client := newTestStatus(t,
+		"r+tcp://127.0.0.1:22?remote=:0",
+		"r+tcp://127.0.0.1:80?remote=:0",
+	)
+	pool := freePortPool(t, 4)
+
+	connect := func() (*link.Link, *link.Link) {
+		c, s := newTestLinks(pool)
+		client.openTunnels(c)
+		st := readStatus(t, client)
+		if !st.Connected {
+			t.Fatal("the status is not connected")
+		}
+		for i, ts := range st.Tunnels {
+			if !ts.Open || ts.RemotePort == 0 || ts.Stats == nil {
+				t.Fatalf("bad status of tunnel %d: %+v", i, ts)
+			}
+		}
+		return c, s
+	}
+	ports := func() []int {
+		client.statusMutex.Lock()
+		defer client.statusMutex.Unlock()
+		return []int{client.statuses[0].RemotePort, client.statuses[1].RemotePort}
+	}
+
+	c, s := connect()
+	first := ports()
+	if first[0] == first[1] {
+		t.Fatalf("the tunnels got the same port %d", first[0])
+	}
+	c.Close()
+	s.Close()
+	client.writeStatus()
+	if st := readStatus(t, client); st.Connected || st.Tunnels[0].Open {
+		t.Errorf("the status is still open after the link is closed: %+v", st)
+	}
+
+	// the pool goes on with the other ports, but the old ones are asked
+	// for again
+	c, s = connect()
+	if got := ports(); got[0] != first[0] || got[1] != first[1] {
+		t.Errorf("got the ports %v after reconnecting, expect %v", got, first)
+	}
+	c.Close()
+	s.Close()
+
+	// a new port is assigned if the old one is taken by another program
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", first[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, s = connect()
+	defer c.Close()
+	defer s.Close()
+	if got := ports(); got[0] == first[0] || got[0] == first[1] || got[1] != first[1] {
+		t.Errorf("got the ports %v with port %d taken, expect a new one and %d", got, first[0], first[1])
+	}
+}
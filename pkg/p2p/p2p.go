@@ -0,0 +1,86 @@
+// Package p2p define the messages of the P2P rendezvous. A client (dialer)
+// ask the server to connect another client registered with a name
+// (acceptor), the server send both of them an Offer, and tell each the
+// public UDP endpoint of the other after both probed the server by UDP.
+// Then they punch the NATs and run a link over proto/udp, or fallback to
+// relay the link by server.
+package p2p
+
+import (
+	"strings"
+	"time"
+)
+
+// the session request actions
+const (
+	// ActionConnect is sent by dialer to server
+	ActionConnect = "/p2p/connect"
+	// ActionOffer is sent by server to acceptor
+	ActionOffer = "/p2p/offer"
+	// ActionEndpoint is sent by server to both clients
+	ActionEndpoint = "/p2p/endpoint"
+)
+
+const (
+	probePrefix = "OTUNNEL PROBE "
+
+	// ProbeInterval is how often a client probe the server, until it get
+	// the endpoint of peer
+	ProbeInterval = 200 * time.Millisecond
+	// EndpointTimeout is how long a client wait the endpoint of peer
+	EndpointTimeout = 10 * time.Second
+
+	// PunchInterval is how often a client send datagrams to peer to open
+	// the NAT mapping
+	PunchInterval = 200 * time.Millisecond
+	// PunchTimeout is how long the dialer try to handshake with acceptor,
+	// the acceptor wait a bit more
+	PunchTimeout = 5 * time.Second
+
+	// RelayTimeout is how long the server wait for both clients to relay
+	RelayTimeout = 15 * time.Second
+)
+
+// Punch is the datagram sent to peer, it is dropped by peer
+var Punch = []byte("OTUNNEL PUNCH")
+
+// ConnectRequest is the body of ActionConnect, Secret is checked by the
+// peer
+type ConnectRequest struct {
+	Peer   string
+	Secret string `json:",omitempty"`
+}
+
+// Offer is the body of ActionOffer, and the response body of
+// ActionConnect. Key is the pre-shared key of proto/udp, Token identify
+// the client in the probes and relay request. ChannelOpen is true if the
+// peer answers the opens of channels. Secret is the one of ConnectRequest,
+// it is only sent to the acceptor.
+type Offer struct {
+	ID          uint32
+	Key         []byte
+	Token       string
+	ChannelOpen bool   `json:",omitempty"`
+	Secret      string `json:",omitempty"`
+}
+
+// Endpoint is the body of ActionEndpoint, Addr is the public UDP endpoint
+// of peer
+type Endpoint struct {
+	ID   uint32
+	Addr string
+}
+
+// Probe return the probe datagram of token
+func Probe(token string) []byte {
+	return []byte(probePrefix + token)
+}
+
+// ParseProbe return the token of a probe datagram
+func ParseProbe(b []byte) (string, bool) {
+	s := string(b)
+	if !strings.HasPrefix(s, probePrefix) || len(s) == len(probePrefix) {
+		return "", false
+	}
+	return s[len(probePrefix):], true
+}
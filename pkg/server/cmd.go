@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -24,6 +26,14 @@ var Command = cli.Command{
 			Value: "",
 			Usage: "secret phrase",
 		},
+		cli.StringFlag{
+			Name:  "cert",
+			Usage: "the certificate file of TLS, listen TLS if --secret is not given",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "the private key file of TLS",
+		},
 		cli.IntFlag{
 			Name:  "keyiter",
 			Usage: "key iter times for pbkdf2",
@@ -37,13 +47,82 @@ var Command = cli.Command{
 			Value: 30,
 			Usage: "keepalive interval",
 		},
+		cli.DurationFlag{
+			Name:  "resume-grace",
+			Value: 30 * time.Second,
+			Usage: "how long a broken link is kept for the client to resume it, 0 means disable resuming",
+		},
+		cli.StringFlag{
+			Name:  "upload-limit",
+			Usage: "max bytes per second from all clients to server, such as 512K or 10M",
+		},
+		cli.StringFlag{
+			Name:  "download-limit",
+			Usage: "max bytes per second from server to all clients, such as 512K or 10M",
+		},
+		cli.StringFlag{
+			Name:  "client-upload-limit",
+			Usage: "max bytes per second from every client to server",
+		},
+		cli.StringFlag{
+			Name:  "client-download-limit",
+			Usage: "max bytes per second from server to every client",
+		},
+		cli.StringFlag{
+			Name:  "limit-burst",
+			Usage: "the burst size of the rate limits, default to one second of the rate",
+		},
+		cli.StringFlag{
+			Name:  "port-pool",
+			Usage: "the ports assigned to the tunnels asking for remote port 0, such as 40000-49999, the system picks one if it is not set",
+		},
+		cli.StringFlag{
+			Name:  "http-addr",
+			Usage: "the address shared by the http tunnels, such as :80, they are routed by the Host header",
+		},
+		cli.StringFlag{
+			Name:  "http-domain",
+			Usage: "the domain of the subdomains of http tunnels, such as tunnel.example.com",
+		},
+		cli.StringFlag{
+			Name:  "tls-addr",
+			Usage: "the address shared by the tls tunnels, such as :443, they are routed by the SNI without decrypting",
+		},
+		cli.StringFlag{
+			Name:  "tls-domain",
+			Usage: "the domain of the subdomains of tls tunnels, such as tunnel.example.com",
+		},
+		cli.StringFlag{
+			Name:  "bind",
+			Usage: "the source address of the connections to the tunnel targets, such as 192.168.1.2",
+		},
+		cli.StringFlag{
+			Name:  "nodelay",
+			Usage: "TCP_NODELAY of the connections to the tunnel targets, true (default) or false",
+		},
+		cli.StringFlag{
+			Name:  "tcp-keepalive",
+			Usage: "the TCP keepalive period of the connections to the tunnel targets, such as 30s, or off (default 15s)",
+		},
+		cli.StringFlag{
+			Name:  "user-timeout",
+			Usage: "TCP_USER_TIMEOUT of the connections to the tunnel targets, such as 30s (linux only)",
+		},
+		cli.StringFlag{
+			Name:  "mark",
+			Usage: "SO_MARK (fwmark) of the connections to the tunnel targets for policy routing (linux only)",
+		},
 	},
 	Action: func(c *cli.Context) {
 		if c.Bool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
 
-		_server := newServer(c)
+		_server, err := newServer(c)
+		if err != nil {
+			logrus.Errorf("start server failed: %s", err)
+			return
+		}
 		_server.Start()
 	},
 }
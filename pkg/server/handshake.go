@@ -1,25 +1,20 @@
 package server
 
 import (
-	"github.com/ooclab/es"
 	pjson "github.com/ooclab/otunnel/pkg/proto/json"
 	"github.com/sirupsen/logrus"
 )
 
-func handshake(conn es.Conn) error {
-	jconn := pjson.NewConn(conn)
-
-	if err := handleAuth(jconn); err != nil {
-		return err
-	}
-
-	return nil
+// handshake do the auth, return the request of client, the response is
+// sent by caller since it depends on the action (new or resume)
+func handshake(c *pjson.Conn) (map[string]interface{}, error) {
+	return handleAuth(c)
 }
 
-func handleAuth(c *pjson.Conn) error {
+func handleAuth(c *pjson.Conn) (map[string]interface{}, error) {
 	m, err := c.Recv()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// username := req["username"]
@@ -30,8 +25,5 @@ func handleAuth(c *pjson.Conn) error {
 	// }
 
 	logrus.Debugf("handle auth, got request: %+v", m)
-	return c.Send(map[string]interface{}{
-		"link_id": 123456,
-		"hello":   "world",
-	})
+	return m, nil
 }
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/ratelimit"
+	"github.com/ooclab/es/tunnel"
+)
+
+// newSinkServer run a TCP server which reads every conn to the end, return
+// its port and the bytes read of every conn
+func newSinkServer(t *testing.T) (int, chan int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	done := make(chan int64, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				n, _ := io.Copy(io.Discard, conn)
+				conn.Close()
+				done <- n
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, done
+}
+
+// dialSink return a conn to the sink, through a tunnel of a new client
+// which does not limit its upload
+func dialSink(t *testing.T, s *Server, sink int) net.Conn {
+	conn, _, err := dialTestServer(s, map[string]interface{}{"action": "new", "channel_open": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := link.NewLink(nil)
+	l.Bind(conn)
+	t.Cleanup(func() { l.Close() })
+
+	cfg := &tunnel.TunnelConfig{
+		Proto:      "tcp",
+		LocalHost:  "127.0.0.1",
+		LocalPort:  freePort(t),
+		RemoteHost: "127.0.0.1",
+		RemotePort: sink,
+	}
+	if err := l.OpenTunnelWithConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_Server_UploadLimit(t *testing.T) {
+	const rate, burst, size = 1024 * 1024, 64 * 1024, 512 * 1024
+	// 80% of the time to send the data after the burst at rate
+	const min = (size - burst) * time.Second / rate * 8 / 10
+
+	for _, c := range []struct {
+		name    string
+		option  func(s *Server)
+		clients int
+	}{
+		{"client", func(s *Server) { s.clientUploadLimit = rate }, 1},
+		{"global", func(s *Server) { s.uploadBucket = ratelimit.NewBucket(rate, burst) }, 2},
+	} {
+		s := newTestServer(t, func(s *Server) {
+			s.limitBurst = burst
+			c.option(s)
+		})
+		sink, done := newSinkServer(t)
+		conns := []net.Conn{}
+		for i := 0; i < c.clients; i++ {
+			conns = append(conns, dialSink(t, s, sink))
+		}
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn net.Conn) {
+				defer wg.Done()
+				conn.Write(make([]byte, size/c.clients))
+				conn.Close()
+			}(conn)
+		}
+		wg.Wait()
+		for i := 0; i < c.clients; i++ {
+			select {
+			case n := <-done:
+				if n != size/int64(c.clients) {
+					t.Errorf("%s: the sink got %d bytes, expect %d", c.name, n, size/c.clients)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: the upload is not done", c.name)
+			}
+		}
+		if d := time.Since(start); d < min {
+			t.Errorf("%s: %d bytes are uploaded in %s, expect %s at least", c.name, size, d, min)
+		}
+	}
+}
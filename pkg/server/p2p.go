@@ -0,0 +1,352 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/ratelimit"
+	"github.com/ooclab/es/session"
+	"github.com/ooclab/otunnel/pkg/p2p"
+	pjson "github.com/ooclab/otunnel/pkg/proto/json"
+	"github.com/sirupsen/logrus"
+)
+
+// p2pSessionTimeout is how long a P2P session is kept for the probes and
+// relay requests
+const p2pSessionTimeout = 60 * time.Second
+
+var errNameTaken = errors.New("the name is registered by another client")
+
+// relayRequest is a new connection which want to relay a P2P link
+type relayRequest struct {
+	conn    es.Conn
+	rawConn net.Conn
+	jconn   *pjson.Conn
+	side    int
+
+	// paired is closed when the request is taken by the peer
+	paired chan struct{}
+}
+
+// p2pSession is a rendezvous of the dialer (side 0) and acceptor (side 1)
+type p2pSession struct {
+	id     uint32
+	key    []byte
+	tokens [2]string
+	links  [2]*link.Link
+	addrs  [2]*net.UDPAddr
+	// channelOpen tell whether the side answers the opens of channels
+	channelOpen [2]bool
+	// secret is sent by dialer, the acceptor checks it
+	secret string
+
+	waiting *relayRequest
+	m       sync.Mutex
+}
+
+func (sess *p2pSession) offer(side int) *p2p.Offer {
+	offer := &p2p.Offer{ID: sess.id, Key: sess.key, Token: sess.tokens[side], ChannelOpen: sess.channelOpen[1-side]}
+	if side == 1 {
+		offer.Secret = sess.secret
+	}
+	return offer
+}
+
+// setAddr save the endpoint of side, return true if the endpoints of both
+// sides are known just now
+func (sess *p2pSession) setAddr(side int, addr *net.UDPAddr) bool {
+	sess.m.Lock()
+	defer sess.m.Unlock()
+	if sess.addrs[side] != nil {
+		return false
+	}
+	sess.addrs[side] = addr
+	return sess.addrs[1-side] != nil
+}
+
+// sendEndpoints tell every side the endpoint of the other
+func (sess *p2pSession) sendEndpoints() {
+	for side, l := range sess.links {
+		body, _ := json.Marshal(p2p.Endpoint{ID: sess.id, Addr: sess.addrs[1-side].String()})
+		if err := sendRequest(l, p2p.ActionEndpoint, body); err != nil {
+			logrus.Warnf("p2p session %d: send endpoint failed: %s", sess.id, err)
+		}
+	}
+}
+
+func sendRequest(l *link.Link, action string, body []byte) error {
+	s, err := l.NewSession()
+	if err != nil {
+		return err
+	}
+	resp, err := s.SendAndWait(&session.Request{Action: action, Body: body})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "success" {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// peerPool keep the named links and the P2P sessions between them
+type peerPool struct {
+	nextID   uint32
+	names    map[string]*linkEntry
+	sessions map[string]*p2pSession // by token
+	m        sync.Mutex
+}
+
+func newPeerPool() *peerPool {
+	return &peerPool{
+		nextID:   1,
+		names:    map[string]*linkEntry{},
+		sessions: map[string]*p2pSession{},
+	}
+}
+
+// Register name the link, a name is never taken over from a live link,
+// or the P2P connects to it would go to another client
+func (p *peerPool) Register(name string, e *linkEntry) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if old := p.names[name]; old != nil {
+		logrus.Warnf("link %d: peer %s is registered by link %d", e.id, name, old.id)
+		return errNameTaken
+	}
+	p.names[name] = e
+	return nil
+}
+
+// Unregister remove the name if it is still of the link
+func (p *peerPool) Unregister(name string, e *linkEntry) {
+	p.m.Lock()
+	if p.names[name] == e {
+		delete(p.names, name)
+	}
+	p.m.Unlock()
+}
+
+func (p *peerPool) Lookup(name string) *linkEntry {
+	p.m.Lock()
+	e := p.names[name]
+	p.m.Unlock()
+	return e
+}
+
+// NewSession create a P2P session from dialer to acceptor, it expires
+// after p2pSessionTimeout
+func (p *peerPool) NewSession(dialer *linkEntry, acceptor *linkEntry, secret string) *p2pSession {
+	sess := &p2pSession{
+		key:         make([]byte, 32),
+		tokens:      [2]string{genResumeToken(), genResumeToken()},
+		links:       [2]*link.Link{dialer.link, acceptor.link},
+		channelOpen: [2]bool{dialer.channelOpen, acceptor.channelOpen},
+		secret:      secret,
+	}
+	rand.Read(sess.key)
+
+	p.m.Lock()
+	sess.id = p.nextID
+	p.nextID++
+	for _, token := range sess.tokens {
+		p.sessions[token] = sess
+	}
+	p.m.Unlock()
+
+	time.AfterFunc(p2pSessionTimeout, func() { p.Delete(sess) })
+	return sess
+}
+
+// Delete forget the tokens of sess, the probes and relay requests of it
+// are ignored
+func (p *peerPool) Delete(sess *p2pSession) {
+	p.m.Lock()
+	for _, token := range sess.tokens {
+		delete(p.sessions, token)
+	}
+	p.m.Unlock()
+}
+
+// Get return the session and side of token
+func (p *peerPool) Get(token string) (*p2pSession, int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	sess := p.sessions[token]
+	if sess == nil {
+		return nil, 0
+	}
+	if sess.tokens[0] == token {
+		return sess, 0
+	}
+	return sess, 1
+}
+
+// p2pRoutes return the session request handlers of link e
+func (s *Server) p2pRoutes(e **linkEntry) []session.Route {
+	return []session.Route{
+		{
+			Action: p2p.ActionConnect,
+			Handler: func(r *session.Request) (*session.Response, error) {
+				return s.handleP2PConnect(*e, r)
+			},
+		},
+	}
+}
+
+// handleP2PConnect create a P2P session for the dialer, and send the offer
+// to the acceptor
+func (s *Server) handleP2PConnect(from *linkEntry, r *session.Request) (*session.Response, error) {
+	req := p2p.ConnectRequest{}
+	if err := json.Unmarshal(r.Body, &req); err != nil {
+		return &session.Response{Status: "load-request-error"}, nil
+	}
+	peer := s.peers.Lookup(req.Peer)
+	if peer == nil || peer == from {
+		logrus.Warnf("link %d: peer %s is not found", from.id, req.Peer)
+		return &session.Response{Status: "peer-not-found"}, nil
+	}
+
+	sess := s.peers.NewSession(from, peer, req.Secret)
+	logrus.Infof("p2p session %d: link %d connect peer %s (link %d)", sess.id, from.id, req.Peer, peer.id)
+
+	// !IMPORTANT! the handler is called in the recv loop of dialer
+	go func() {
+		body, _ := json.Marshal(sess.offer(1))
+		if err := sendRequest(peer.link, p2p.ActionOffer, body); err != nil {
+			// the dialer can not relay without the acceptor
+			logrus.Warnf("p2p session %d: send offer to peer %s failed: %s", sess.id, req.Peer, err)
+			s.peers.Delete(sess)
+		}
+	}()
+
+	body, _ := json.Marshal(sess.offer(0))
+	return &session.Response{Status: "success", Body: body}, nil
+}
+
+// startRendezvous listen the UDP port of server address, the clients probe
+// it to tell their public endpoints
+func (s *Server) startRendezvous() {
+	addr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err == nil {
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP("udp", addr); err == nil {
+			logrus.Infof("start p2p rendezvous on udp %s success", conn.LocalAddr())
+			go s.serveRendezvous(conn)
+			return
+		}
+	}
+	logrus.Warnf("start p2p rendezvous on udp %s failed, the p2p links are relayed: %s", s.addr, err)
+}
+
+func (s *Server) serveRendezvous(conn *net.UDPConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logrus.Errorf("p2p rendezvous quit: %s", err)
+			return
+		}
+		token, ok := p2p.ParseProbe(buf[:n])
+		if !ok {
+			continue
+		}
+		sess, side := s.peers.Get(token)
+		if sess == nil {
+			continue
+		}
+		if sess.setAddr(side, addr) {
+			logrus.Debugf("p2p session %d: endpoints %s, %s", sess.id, sess.addrs[0], sess.addrs[1])
+			go sess.sendEndpoints()
+		}
+	}
+}
+
+// handleRelay pair the relay requests of both sides of a P2P session, the
+// request arrived later runs the relay
+func (s *Server) handleRelay(req map[string]interface{}, r *relayRequest) {
+	token, _ := req["token"].(string)
+	sess, side := s.peers.Get(token)
+	if sess == nil {
+		r.jconn.Send(map[string]interface{}{"error": "p2p session is not found"})
+		r.conn.Close()
+		return
+	}
+	r.side = side
+	r.paired = make(chan struct{})
+
+	sess.m.Lock()
+	if w := sess.waiting; w != nil && w.side != r.side {
+		sess.waiting = nil
+		sess.m.Unlock()
+		close(w.paired)
+		s.relay(sess, w, r)
+		return
+	}
+	if old := sess.waiting; old != nil {
+		// the side request again
+		old.conn.Close()
+		close(old.paired)
+	}
+	sess.waiting = r
+	sess.m.Unlock()
+
+	select {
+	case <-r.paired:
+	case <-time.After(p2p.RelayTimeout):
+		sess.m.Lock()
+		if sess.waiting == r {
+			sess.waiting = nil
+			sess.m.Unlock()
+			logrus.Warnf("p2p session %d: the peer does not relay in %s", sess.id, p2p.RelayTimeout)
+			r.jconn.Send(map[string]interface{}{"error": "the peer does not relay"})
+			r.conn.Close()
+			return
+		}
+		sess.m.Unlock()
+		<-r.paired
+	}
+}
+
+// relay copy the frames between a and b, until any side is broken
+func (s *Server) relay(sess *p2pSession, a, b *relayRequest) {
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	for _, r := range []*relayRequest{a, b} {
+		if err := r.jconn.Send(map[string]interface{}{"relayed": true}); err != nil {
+			logrus.Errorf("p2p session %d: relay handshake failed: %s", sess.id, err)
+			return
+		}
+		// Important! cancel timeout!
+		r.rawConn.SetReadDeadline(time.Time{})
+	}
+	logrus.Infof("p2p session %d: relay the link", sess.id)
+
+	// the relayed frames pass both directions of server
+	limiter := ratelimit.Limiter{s.uploadBucket, s.downloadBucket}
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src es.Conn) {
+		for {
+			m, err := src.Recv()
+			if err != nil {
+				break
+			}
+			limiter.Wait(len(m))
+			if err := dst.Send(m); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go pipe(a.conn, b.conn)
+	go pipe(b.conn, a.conn)
+	<-done
+	logrus.Infof("p2p session %d: relay is done", sess.id)
+}
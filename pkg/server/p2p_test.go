@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/session"
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/otunnel/pkg/p2p"
+	pjson "github.com/ooclab/otunnel/pkg/proto/json"
+)
+
+// newTestServer run a server on a loopback port, the rendezvous listens
+// the UDP port of the same number. The options are applied before it
+// serves.
+func newTestServer(t *testing.T, options ...func(s *Server)) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Proto:             "tcp",
+		Type:              "default",
+		addr:              l.Addr().String(),
+		keepaliveInterval: 30 * time.Second,
+		links:             newLinkPool(),
+		peers:             newPeerPool(),
+		shared:            map[string]tunnel.SharedListener{},
+		sharedAddrs:       map[string]string{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	go s.serve(l)
+	return s
+}
+
+// dialTestServer connect to server and handshake with req
+func dialTestServer(s *Server, req map[string]interface{}) (es.Conn, map[string]interface{}, error) {
+	rawConn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := es.NewBaseConn(rawConn)
+	resp, err := pjson.NewConn(conn).Request(req)
+	if err == nil {
+		if e, ok := resp["error"].(string); ok {
+			err = errors.New(e)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, resp, nil
+}
+
+// newTestClient create the link of a client, it runs the routes
+func newTestClient(s *Server, name string, routes ...session.Route) (*link.Link, error) {
+	req := map[string]interface{}{"action": "new", "channel_open": true}
+	if name != "" {
+		req["name"] = name
+	}
+	conn, _, err := dialTestServer(s, req)
+	if err != nil {
+		return nil, err
+	}
+	l := link.NewLink(&link.LinkConfig{Routes: routes})
+	l.Bind(conn)
+	return l, nil
+}
+
+// peerRoutes pass the offers and endpoints sent by server to the channels
+func peerRoutes(offers chan *p2p.Offer, endpoints chan *p2p.Endpoint) []session.Route {
+	return []session.Route{
+		{Action: p2p.ActionOffer, Handler: func(r *session.Request) (*session.Response, error) {
+			offer := &p2p.Offer{}
+			json.Unmarshal(r.Body, offer)
+			offers <- offer
+			return &session.Response{Status: "success"}, nil
+		}},
+		{Action: p2p.ActionEndpoint, Handler: func(r *session.Request) (*session.Response, error) {
+			endpoint := &p2p.Endpoint{}
+			json.Unmarshal(r.Body, endpoint)
+			endpoints <- endpoint
+			return &session.Response{Status: "success"}, nil
+		}},
+	}
+}
+
+// connectPeer ask server to connect peer, return the offer to dialer
+func connectPeer(l *link.Link, peer, secret string) (*p2p.Offer, error) {
+	sess, err := l.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(p2p.ConnectRequest{Peer: peer, Secret: secret})
+	resp, err := sess.SendAndWait(&session.Request{Action: p2p.ActionConnect, Body: body})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, errors.New(resp.Status)
+	}
+	offer := &p2p.Offer{}
+	return offer, json.Unmarshal(resp.Body, offer)
+}
+
+func Test_Server_RegisterName(t *testing.T) {
+	s := newTestServer(t)
+	alice, err := newTestClient(s, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestClient(s, "alice"); err == nil {
+		t.Fatal("the name of a live link should not be taken over")
+	}
+
+	// the name is free after the link is closed
+	alice.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.peers.Lookup("alice") != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := newTestClient(s, "alice"); err != nil {
+		t.Errorf("register the name again: %s", err)
+	}
+}
+
+func Test_Server_P2PRefused(t *testing.T) {
+	s := newTestServer(t)
+	refuse := session.Route{Action: p2p.ActionOffer, Handler: func(r *session.Request) (*session.Response, error) {
+		return &session.Response{Status: "wrong-peer-secret"}, nil
+	}}
+	if _, err := newTestClient(s, "alice", refuse); err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := newTestClient(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := connectPeer(dialer, "alice", "bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the session is dropped, the dialer can not relay
+	deadline := time.Now().Add(2 * time.Second)
+	for sess, _ := s.peers.Get(offer.Token); sess != nil; sess, _ = s.peers.Get(offer.Token) {
+		if time.Now().After(deadline) {
+			t.Fatal("the session refused by the acceptor is kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, err := dialTestServer(s, map[string]interface{}{"action": "relay", "token": offer.Token}); err == nil {
+		t.Error("relay of a refused session should fail")
+	}
+}
+
+func Test_Server_P2PRelay(t *testing.T) {
+	s := newTestServer(t)
+	offers := make(chan *p2p.Offer, 1)
+	endpoints := make(chan *p2p.Endpoint, 2)
+	if _, err := newTestClient(s, "alice", peerRoutes(offers, endpoints)...); err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := newTestClient(s, "", peerRoutes(nil, endpoints)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := connectPeer(dialer, "bob", "s3cr3t"); err == nil {
+		t.Fatal("connect an unknown peer should fail")
+	}
+	dialerOffer, err := connectPeer(dialer, "alice", "s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var acceptorOffer *p2p.Offer
+	select {
+	case acceptorOffer = <-offers:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the acceptor got no offer")
+	}
+	if dialerOffer.ID != acceptorOffer.ID || string(dialerOffer.Key) != string(acceptorOffer.Key) || dialerOffer.Token == acceptorOffer.Token {
+		t.Fatalf("bad offers %+v %+v", dialerOffer, acceptorOffer)
+	}
+	if !dialerOffer.ChannelOpen || !acceptorOffer.ChannelOpen {
+		t.Error("both peers answer the opens of channels")
+	}
+	if acceptorOffer.Secret != "s3cr3t" || dialerOffer.Secret != "" {
+		t.Errorf("the secret should be passed to the acceptor only, got %q and %q", acceptorOffer.Secret, dialerOffer.Secret)
+	}
+
+	// the probes tell the server the endpoints, and each side gets the
+	// other one
+	saddr, _ := net.ResolveUDPAddr("udp", s.addr)
+	socks := map[string]*net.UDPConn{}
+	for _, offer := range []*p2p.Offer{dialerOffer, acceptorOffer} {
+		uconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uconn.Close()
+		socks[uconn.LocalAddr().String()] = uconn
+		uconn.WriteToUDP(p2p.Probe(offer.Token), saddr)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-endpoints:
+			if e.ID != dialerOffer.ID || socks[e.Addr] == nil {
+				t.Errorf("bad endpoint %+v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no endpoint is sent")
+		}
+	}
+
+	// the punch is failed, both sides fallback to relay
+	type relayed struct {
+		conn es.Conn
+		err  error
+	}
+	results := make(chan relayed, 2)
+	for _, offer := range []*p2p.Offer{dialerOffer, acceptorOffer} {
+		go func(token string) {
+			conn, _, err := dialTestServer(s, map[string]interface{}{"action": "relay", "token": token})
+			results <- relayed{conn, err}
+		}(offer.Token)
+	}
+	if _, _, err := dialTestServer(s, map[string]interface{}{"action": "relay", "token": "bad"}); err == nil {
+		t.Error("relay with a bad token should fail")
+	}
+	conns := []es.Conn{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			conns = append(conns, r.conn)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the relay is not paired")
+		}
+	}
+
+	// a link runs over the relayed conns
+	a := link.NewLink(nil)
+	b := link.NewLink(&link.LinkConfig{IsServerSide: true})
+	go a.Bind(conns[0])
+	go b.Bind(conns[1])
+	defer a.Close()
+	defer b.Close()
+	if _, err := a.Ping(); err != nil {
+		t.Fatalf("ping over the relay: %s", err)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	pjson "github.com/ooclab/otunnel/pkg/proto/json"
+	"github.com/sirupsen/logrus"
+)
+
+// resumeRequest is a new connection which want to resume a link
+type resumeRequest struct {
+	conn    es.Conn
+	rawConn net.Conn
+	jconn   *pjson.Conn
+	recv    uint64
+
+	// accepted tell the connection handler whether the link take the conn
+	accepted chan bool
+}
+
+// linkEntry is a link kept by server, it can be resumed by the token
+// during the grace period after its connection is broken
+type linkEntry struct {
+	id       uint32
+	token    string
+	link     *link.Link
+	resumeCh chan *resumeRequest
+	done     chan struct{}
+
+	// channelOpen is true if the client answers the opens of channels
+	channelOpen bool
+}
+
+// waitResume wait a resume request until timeout
+func (e *linkEntry) waitResume(timeout time.Duration) *resumeRequest {
+	select {
+	case r := <-e.resumeCh:
+		return r
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+type linkPool struct {
+	nextID uint32
+	pool   map[uint32]*linkEntry
+	m      sync.Mutex
+}
+
+func newLinkPool() *linkPool {
+	return &linkPool{
+		nextID: 1,
+		pool:   map[uint32]*linkEntry{},
+	}
+}
+
+// New save a link, a resume token is generated if it is resumable
+func (p *linkPool) New(l *link.Link, resumable bool) *linkEntry {
+	e := &linkEntry{
+		link:     l,
+		resumeCh: make(chan *resumeRequest),
+		done:     make(chan struct{}),
+	}
+	if resumable {
+		e.token = genResumeToken()
+	}
+
+	p.m.Lock()
+	for {
+		e.id = p.nextID
+		p.nextID++
+		if _, ok := p.pool[e.id]; !ok && e.id != 0 {
+			break
+		}
+	}
+	p.pool[e.id] = e
+	p.m.Unlock()
+	return e
+}
+
+func (p *linkPool) Get(id uint32) *linkEntry {
+	p.m.Lock()
+	e := p.pool[id]
+	p.m.Unlock()
+	return e
+}
+
+func (p *linkPool) Delete(e *linkEntry) {
+	p.m.Lock()
+	delete(p.pool, e.id)
+	p.m.Unlock()
+	close(e.done)
+}
+
+func genResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Errorf("generate resume token failed: %s", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// resumeLink hand the conn over to the link it want to resume, return
+// false if the link can not be resumed
+func (s *Server) resumeLink(req map[string]interface{}, r *resumeRequest) bool {
+	id, _ := req["link_id"].(float64)
+	token, _ := req["resume_token"].(string)
+	recv, _ := req["recv"].(float64)
+
+	e := s.links.Get(uint32(id))
+	if e == nil || e.token == "" || subtle.ConstantTimeCompare([]byte(e.token), []byte(token)) != 1 {
+		logrus.Warnf("link %d is not found, can not resume it", uint32(id))
+		return false
+	}
+
+	r.recv = uint64(recv)
+	r.accepted = make(chan bool, 1)
+
+	// the old conn may be not broken in this side yet
+	e.link.Stop()
+
+	select {
+	case e.resumeCh <- r:
+		return <-r.accepted
+	case <-e.done:
+		return false
+	case <-time.After(s.resumeGrace):
+		logrus.Warnf("link %d is busy, can not resume it", e.id)
+		return false
+	}
+}
+
+// waitResume wait until the link is resumed in the grace period, return
+// the new conn, or nil if it is not resumed
+func (s *Server) waitResume(e *linkEntry) es.Conn {
+	logrus.Warnf("link %d is offline, keep it %s for resuming", e.id, s.resumeGrace)
+	deadline := time.Now().Add(s.resumeGrace)
+	for {
+		r := e.waitResume(time.Until(deadline))
+		if r == nil {
+			logrus.Warnf("link %d is not resumed in %s, close it", e.id, s.resumeGrace)
+			return nil
+		}
+		err := s.doResume(e, r)
+		if err == nil {
+			logrus.Infof("link %d is resumed", e.id)
+			return r.conn
+		}
+		logrus.Errorf("resume link %d failed: %s", e.id, err)
+		if err == link.ErrResumeLost {
+			return nil
+		}
+	}
+}
+
+// doResume bind the link with the conn of resume request
+func (s *Server) doResume(e *linkEntry, r *resumeRequest) error {
+	l := e.link
+	if err := l.CheckResume(r.recv); err != nil {
+		r.accepted <- false
+		return err
+	}
+
+	err := r.jconn.Send(map[string]interface{}{
+		"link_id":      e.id,
+		"resume_token": e.token,
+		"resumed":      true,
+		"recv":         l.RecvCount(),
+	})
+	r.accepted <- true
+	if err != nil {
+		r.conn.Close()
+		return err
+	}
+
+	// Important! cancel timeout!
+	r.rawConn.SetReadDeadline(time.Time{})
+
+	return l.Resume(r.conn, r.recv)
+}
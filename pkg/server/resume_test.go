@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/tunnel"
+)
+
+// newEchoServer run a TCP server which echoes the data of every conn,
+// return its port
+func newEchoServer(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// freePort return a loopback port which can be listened now
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func Test_Server_Resume(t *testing.T) {
+	s := newTestServer(t, func(s *Server) { s.resumeGrace = 5 * time.Second })
+	conn, resp, err := dialTestServer(s, map[string]interface{}{"action": "new", "channel_open": true, "resume": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := resp["link_id"].(float64)
+	token, _ := resp["resume_token"].(string)
+	if token == "" {
+		t.Fatal("the server returns no resume token")
+	}
+	l := link.NewLink(&link.LinkConfig{Resumable: true})
+	l.Bind(conn)
+	defer l.Close()
+
+	cfg := &tunnel.TunnelConfig{
+		Proto:      "tcp",
+		LocalHost:  "127.0.0.1",
+		LocalPort:  freePort(t),
+		RemoteHost: "127.0.0.1",
+		RemotePort: newEchoServer(t),
+	}
+	if err := l.OpenTunnelWithConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	go c.Write(data)
+
+	// the connection of the link is dropped in the middle of the transfer
+	got := make([]byte, len(data))
+	part := len(data) / 4
+	if _, err := io.ReadFull(c, got[:part]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	l.Wait()
+	recv := l.RecvCount()
+
+	// a wrong token gets a new link
+	bad, resp, err := dialTestServer(s, map[string]interface{}{
+		"action": "resume", "link_id": id, "resume_token": "bad" + token, "recv": recv,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Close()
+	if resp["resumed"] == true || resp["link_id"] == id {
+		t.Fatalf("link %v is resumed by a wrong token: %v", id, resp)
+	}
+
+	conn, resp, err = dialTestServer(s, map[string]interface{}{
+		"action": "resume", "link_id": id, "resume_token": token, "recv": recv,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerRecv, _ := resp["recv"].(float64)
+	if resp["resumed"] != true {
+		t.Fatalf("link %v is not resumed: %v", id, resp)
+	}
+	if err := l.Resume(conn, uint64(peerRecv)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the channel is still open and no byte is lost
+	if _, err := io.ReadFull(c, got[part:]); err != nil {
+		t.Fatalf("read after the link is resumed: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the data echoed over the resumed link is different")
+	}
+}
@@ -2,13 +2,19 @@ package server
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net"
 	"time"
 
 	"github.com/ooclab/es"
 	"github.com/ooclab/es/ecrypt"
 	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/ratelimit"
+	"github.com/ooclab/es/tunnel"
+	esutil "github.com/ooclab/es/util"
+	pjson "github.com/ooclab/otunnel/pkg/proto/json"
 	"github.com/ooclab/otunnel/pkg/util"
+	"github.com/ooclab/otunnel/pkg/vhost"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -26,6 +32,9 @@ func StartTLSListener(addr string, caFile string, certFile string, keyFile strin
 		return nil, err
 	}
 
+	// the clients may pin the certificate by the fingerprint
+	logrus.Infof("the fingerprint of certificate: %s", util.CertFingerprint(cert.Certificate[0]))
+
 	config := tls.Config{Certificates: []tls.Certificate{cert}}
 	return tls.Listen("tcp", addr, &config)
 }
@@ -48,13 +57,41 @@ type Server struct {
 
 	keepaliveInterval time.Duration
 
+	// resumeGrace is how long a broken link is kept for resuming
+	resumeGrace time.Duration
+	links       *linkPool
+
+	// peers are the links named by clients for P2P
+	peers *peerPool
+
+	// rate limits in bytes per second, upload is from client to server.
+	// The global buckets are shared by all links, see linkLimiters.
+	uploadBucket        *ratelimit.Bucket
+	downloadBucket      *ratelimit.Bucket
+	clientUploadLimit   int64
+	clientDownloadLimit int64
+	limitBurst          int64
+
+	// dialOptions is the default socket options of the connections to
+	// the targets of tunnels
+	dialOptions *esutil.DialOptions
+
+	// shared are the listeners shared by the http and tls tunnels, see
+	// pkg/vhost, and the registry of stcp services. sharedAddrs are the
+	// addresses of the listeners.
+	shared      map[string]tunnel.SharedListener
+	sharedAddrs map[string]string
+
+	// portPool assign the remote ports of the tunnels asking for port 0
+	portPool *tunnel.PortPool
+
 	// tls connection needed!
 	caFile   string
 	keyFile  string
 	certFile string
 }
 
-func newServer(c *cli.Context) *Server {
+func newServer(c *cli.Context) (*Server, error) {
 	addr := c.Args().First()
 	if len(addr) == 0 {
 		addr = ":10000"
@@ -65,9 +102,48 @@ func newServer(c *cli.Context) *Server {
 		addr:              addr,
 		secret:            util.GenSecret(c.String("secret"), c.Int("keyiter"), c.Int("keylen")),
 		keepaliveInterval: time.Duration(c.Int("keepalive")) * time.Second,
+		resumeGrace:       c.Duration("resume-grace"),
+		links:             newLinkPool(),
+		peers:             newPeerPool(),
 		caFile:            c.String("ca"),
 		certFile:          c.String("cert"),
 		keyFile:           c.String("key"),
+		shared:            map[string]tunnel.SharedListener{},
+		sharedAddrs:       map[string]string{},
+	}
+	s.shared["stcp"] = newServiceRegistry()
+	if addr := c.String("http-addr"); addr != "" {
+		s.shared["http"] = vhost.NewHTTP(c.String("http-domain"))
+		s.sharedAddrs["http"] = addr
+	}
+	if addr := c.String("tls-addr"); addr != "" {
+		s.shared["tls"] = vhost.NewTLS(c.String("tls-domain"))
+		s.sharedAddrs["tls"] = addr
+	}
+
+	var err error
+	sizeFlag := func(name string) int64 {
+		v, e := util.ParseSize(c.String(name))
+		if e != nil && err == nil {
+			err = fmt.Errorf("--%s: %s", name, e)
+		}
+		return v
+	}
+	s.limitBurst = sizeFlag("limit-burst")
+	s.uploadBucket = ratelimit.NewBucket(sizeFlag("upload-limit"), s.limitBurst)
+	s.downloadBucket = ratelimit.NewBucket(sizeFlag("download-limit"), s.limitBurst)
+	s.clientUploadLimit = sizeFlag("client-upload-limit")
+	s.clientDownloadLimit = sizeFlag("client-download-limit")
+	if err != nil {
+		return nil, err
+	}
+	if s.dialOptions, err = util.ParseDialOptions(c.String); err != nil {
+		return nil, err
+	}
+	if v := c.String("port-pool"); v != "" {
+		if s.portPool, err = tunnel.ParsePortPool(v); err != nil {
+			return nil, fmt.Errorf("--port-pool: %s", err)
+		}
 	}
 
 	if len(s.secret) > 0 {
@@ -78,7 +154,38 @@ func newServer(c *cli.Context) *Server {
 		s.Type = "default"
 	}
 
-	return s
+	return s, nil
+}
+
+// linkLimiters return the read and recv limiters of a new link. The server
+// limits the download in the channel read loops, and the upload in the
+// recv loop of the link, so a client which does not keep the limit only
+// stalls its own link.
+func (s *Server) linkLimiters(req map[string]interface{}) (read, recv ratelimit.Limiter) {
+	download, _ := req["download_limit"].(float64)
+	burst, _ := req["limit_burst"].(float64)
+	read = ratelimit.Limiter{
+		s.downloadBucket,
+		ratelimit.NewBucket(s.clientDownloadLimit, s.limitBurst),
+		// the download limit asked by client
+		ratelimit.NewBucket(int64(download), int64(burst)),
+	}
+	recv = ratelimit.Limiter{
+		s.uploadBucket,
+		ratelimit.NewBucket(s.clientUploadLimit, s.limitBurst),
+	}
+	return
+}
+
+// clientUpload return the upload limit sent to every client. The server
+// enforces it anyway, the client keeps under it so the backpressure
+// reaches the local conns sooner.
+func (s *Server) clientUpload() int64 {
+	limit := s.clientUploadLimit
+	if global := s.uploadBucket.Rate(); global > 0 && (limit == 0 || global < limit) {
+		limit = global
+	}
+	return limit
 }
 
 // Start run a server
@@ -110,6 +217,17 @@ func (s *Server) startTCP() {
 	}
 
 	logrus.Infof("start (%s) server on %s success", s.Type, s.addr)
+	s.serve(l)
+}
+
+// serve start the rendezvous and shared listeners, and serve the clients
+// of l
+func (s *Server) serve(l net.Listener) {
+	s.startRendezvous()
+	if err := s.startShared(); err != nil {
+		logrus.Errorf("start shared listener failed: %s", err)
+		return
+	}
 
 	for {
 		conn, err := l.Accept()
@@ -125,6 +243,19 @@ func (s *Server) startTCP() {
 	}
 }
 
+// startShared listen the ports shared by tunnels
+func (s *Server) startShared() error {
+	for proto, addr := range s.sharedAddrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("start %s virtual hosts on %s success", proto, l.Addr())
+		go s.shared[proto].(*vhost.Router).Serve(l)
+	}
+	return nil
+}
+
 func (s *Server) handleTCPClient(rawConn net.Conn) {
 	var conn es.Conn
 	if s.Type == "aes" {
@@ -134,26 +265,106 @@ func (s *Server) handleTCPClient(rawConn net.Conn) {
 	} else {
 		conn = es.NewBaseConn(rawConn)
 	}
-	defer conn.Close()
 
 	// Important!
 	rawConn.SetReadDeadline(time.Now().Add(time.Second * 6))
 
-	if err := handshake(conn); err != nil {
+	jconn := pjson.NewConn(conn)
+	req, err := handshake(jconn)
+	if err != nil {
 		logrus.Errorf("handshake failed: %s", err)
+		conn.Close()
 		return
 	}
 
-	// Important! cancel timeout!
-	rawConn.SetReadDeadline(time.Time{})
+	if req["action"] == "relay" {
+		s.handleRelay(req, &relayRequest{conn: conn, rawConn: rawConn, jconn: jconn})
+		return
+	}
+
+	if req["action"] == "resume" && s.resumeGrace > 0 {
+		r := &resumeRequest{conn: conn, rawConn: rawConn, jconn: jconn}
+		if s.resumeLink(req, r) {
+			// the conn is taken by the resumed link
+			return
+		}
+	}
 
 	// client_name := conn.((*net.TCPConn)).RemoteAddr()
+	resumable := s.resumeGrace > 0 && req["resume"] == true
+	readLimiter, recvLimiter := s.linkLimiters(req)
+	// an old client opens the channels by their first data
+	channelOpen := req["channel_open"] == true
+	var e *linkEntry
 	l := link.NewLink(&link.LinkConfig{
 		IsServerSide:      true,
 		KeepaliveInterval: s.keepaliveInterval,
+		Resumable:         resumable,
+		ReadLimiter:       readLimiter,
+		RecvLimiter:       recvLimiter,
+		Routes:            s.p2pRoutes(&e),
+		DialOptions:       s.dialOptions,
+		SharedListeners:   s.shared,
+		PortPool:          s.portPool,
+		LegacyChannels:    !channelOpen,
 	})
+	e = s.links.New(l, resumable)
+	e.channelOpen = channelOpen
+
+	name, _ := req["name"].(string)
+	if name != "" {
+		if err := s.peers.Register(name, e); err != nil {
+			jconn.Send(map[string]interface{}{"error": fmt.Sprintf("name %s: %s", name, err)})
+			s.links.Delete(e)
+			l.Close()
+			conn.Close()
+			return
+		}
+		defer s.peers.Unregister(name, e)
+	}
+
+	resp := map[string]interface{}{
+		"link_id":      e.id,
+		"resumed":      false,
+		"channel_open": true,
+	}
+	if e.token != "" {
+		resp["resume_token"] = e.token
+	}
+	if upload := s.clientUpload(); upload > 0 {
+		resp["upload_limit"] = upload
+		resp["limit_burst"] = s.limitBurst
+	}
+	if err := jconn.Send(resp); err != nil {
+		logrus.Errorf("handshake failed: %s", err)
+		s.links.Delete(e)
+		l.Close()
+		conn.Close()
+		return
+	}
+
+	// Important! cancel timeout!
+	rawConn.SetReadDeadline(time.Time{})
+
+	s.serveLink(e, conn)
+	logrus.Warnf("client %#v is offline", conn)
+}
+
+// serveLink run the link until it is broken and can not be resumed
+func (s *Server) serveLink(e *linkEntry, conn es.Conn) {
+	l := e.link
 	defer l.Close()
+	defer s.links.Delete(e)
+
 	l.Bind(conn)
-	l.Wait()
-	logrus.Warnf("client %#v is offline", conn)
+	for {
+		l.Wait()
+		conn.Close()
+		if e.token == "" {
+			return
+		}
+		if conn = s.waitResume(e); conn == nil {
+			return
+		}
+	}
 }
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ooclab/es/tunnel"
+	esutil "github.com/ooclab/es/util"
+	"github.com/sirupsen/logrus"
+)
+
+// serviceRegistry keep the stcp services of all links, the channels of the
+// visitors are relayed to them in server, so the services have no public
+// port. It implements tunnel.ServiceDialer.
+type serviceRegistry struct {
+	services map[string]*tunnel.Tunnel
+	m        sync.Mutex
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{services: map[string]*tunnel.Tunnel{}}
+}
+
+// Register claim the service name of t
+func (r *serviceRegistry) Register(t *tunnel.Tunnel) error {
+	name := t.Config.Service
+	if name == "" {
+		return errors.New("stcp: a service name is required")
+	}
+	if t.Config.Secret == "" {
+		return errors.New("stcp: a secret is required")
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if other := r.services[name]; other != nil && other != t {
+		return fmt.Errorf("stcp: service %s is taken by another tunnel", name)
+	}
+	r.services[name] = t
+	logrus.Infof("stcp: register service %s of tunnel %s", name, t)
+	return nil
+}
+
+// Unregister release the service name of t
+func (r *serviceRegistry) Unregister(t *tunnel.Tunnel) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.services[t.Config.Service] == t {
+		delete(r.services, t.Config.Service)
+		logrus.Infof("stcp: unregister service %s", t.Config.Service)
+	}
+}
+
+// Dial connect the visitor tunnel t to its service, the data is copied
+// between the channels of both links by a pipe
+func (r *serviceRegistry) Dial(t *tunnel.Tunnel) (net.Conn, error) {
+	name := t.Config.Service
+	r.m.Lock()
+	service := r.services[name]
+	r.m.Unlock()
+	if service == nil {
+		return nil, fmt.Errorf("stcp: service %s is not found", name)
+	}
+	secret := service.Config.Secret
+	if t.Config.Secret == "" || subtle.ConstantTimeCompare([]byte(t.Config.Secret), []byte(secret)) != 1 {
+		return nil, fmt.Errorf("stcp: wrong secret for service %s", name)
+	}
+	if !service.Healthy() {
+		return nil, fmt.Errorf("stcp: the target of service %s is down", name)
+	}
+
+	visitor, conn := esutil.Pipe()
+	go service.ServeConn(conn)
+	logrus.Debugf("stcp: tunnel %s visit service %s", t, name)
+	return visitor, nil
+}
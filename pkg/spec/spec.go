@@ -0,0 +1,946 @@
+// Package spec parse and format the tunnel spec of the -t option.
+//
+// Two forms are supported:
+//
+//	r+tcp://[::1]:22?remote=[::]:50022&name=ssh   (URL form)
+//	r:tcp:127.0.0.1:22::50022[:weight]            (legacy form)
+//
+// In the URL form, the scheme is "r" (reverse) or "f" (forward) with an
+// optional "+proto" (tcp by default), the authority is the local address
+// and the remote address is given by the remote option. The options are
+// a URL query, so '&', '=' and '%' in a value are escaped like %26. IPv6
+// hosts must be enclosed in brackets in both forms.
+//
+// The ports can be ranges of the same size, they are opened as one tunnel:
+//
+//	r:tcp:127.0.0.1:30000-30100::40000-40100
+//	r+udp://127.0.0.1:5000-5009?remote=:45000-45009
+//
+// The remote port 0 of a reverse tunnel is assigned by server:
+//
+//	r:tcp:127.0.0.1:22::0
+//
+// A dynamic tunnel ("d") listens SOCKS5 locally and has no remote address,
+// the remote endpoint dial the destinations requested by SOCKS clients,
+// "d+http" listens an HTTP proxy instead:
+//
+//	d://127.0.0.1:1080?user=alice&password=secret  (URL form)
+//	d+http://127.0.0.1:3128?allow=*.example.com    (URL form)
+//	d:[bind:]port                                 (legacy form)
+//
+// An http or tls tunnel is reverse and has no remote address either, it is
+// served on the shared port of server by the host names (URL form only),
+// a tls tunnel is routed by SNI and the TLS is terminated by the client:
+//
+//	r+http://127.0.0.1:8080?subdomain=app1&domain=app.example.com
+//	r+tls://127.0.0.1:8443?domain=secure.example.com
+//
+// An stcp tunnel is a private service relayed by server (URL form only),
+// "r" registers the service without a public port, and "f" listens locally
+// for its visitors, both sides have the same secret:
+//
+//	r+stcp://127.0.0.1:22?service=ssh&secret=s3cr3t
+//	f+stcp://127.0.0.1:2222?service=ssh&secret=s3cr3t
+//
+// The reverse tcp tunnels of many clients can join a group on the same
+// remote port with the secret of the group, the connections are balanced
+// between them:
+//
+//	r+tcp://127.0.0.1:80?remote=:8080&group=web&secret=s3cr3t&balance=least-conn
+//
+// The side which dials the target can check its health, the other side
+// rejects new connections while it is down:
+//
+//	r+tcp://127.0.0.1:80?remote=:8080&health=http&health-path=/healthz
+//
+// The dialing side can have other targets, a new channel tries them in turn
+// until one is connected:
+//
+//	r+tcp://10.0.0.1:80?remote=:8080&targets=10.0.0.2:80,10.0.0.3:80&target-balance=backup
+//
+// The channels of a tunnel can be limited in number, idle time and
+// lifetime:
+//
+//	r+tcp://127.0.0.1:80?remote=:8080&max-conns=100&conn-queue=20&idle-timeout=5m&max-lifetime=24h
+package spec
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ooclab/es/tunnel"
+	esutil "github.com/ooclab/es/util"
+	"github.com/ooclab/otunnel/pkg/util"
+)
+
+const (
+	// LegacyFormat is the usage of the legacy form
+	LegacyFormat = "r|f:proto:local_host:local_port:remote_host:remote_port[:weight] or d:[bind:]port"
+	// URLFormat is the usage of the URL form
+	URLFormat = "r|f[+proto]://local_host:local_port?remote=remote_host:remote_port[&option=value...] or d://bind:port[?option=value...]"
+
+	// defaultDynamicBind is the listen host of "d:port", a SOCKS server
+	// should not be open to everyone by default
+	defaultDynamicBind = "127.0.0.1"
+)
+
+var (
+	nameRe      = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	subdomainRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+	domainRe    = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?\.)+[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+)
+
+// Error is a spec parse error, Field points at the bad part of the spec
+type Error struct {
+	Spec  string
+	Field string
+	Value string
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tunnel spec %q: bad %s %q: %s", e.Spec, e.Field, e.Value, e.Msg)
+}
+
+// Spec is a parsed tunnel spec
+type Spec struct {
+	Reverse    bool
+	Dynamic    bool
+	Proto      string
+	LocalHost  string
+	LocalPort  int
+	RemoteHost string
+	RemotePort int
+	// PortCount is the size of the port ranges, 0 for one port
+	PortCount int
+
+	// options
+	Name   string
+	Weight int
+
+	// rate limits in bytes per second, 0 means no limit
+	Upload   int64
+	Download int64
+	Burst    int64
+
+	// socket options of the connections to the target, see
+	// util.DialOptionNames
+	Dial esutil.DialOptions
+
+	// the proxy auth of dynamic tunnel, the password is never formatted
+	User     string
+	Password string
+	// the destinations the clients of dynamic tunnel can connect
+	Allow esutil.AllowList
+
+	// the host names of http and tls tunnel
+	Subdomain string
+	Domain    string
+
+	// the service name of stcp tunnel, and its secret which is never
+	// formatted, a tunnel group has the secret too
+	Service string
+	Secret  string
+
+	// the group of the tunnels on the same remote port, and how it picks
+	// a tunnel for a connection
+	Group   string
+	Balance string
+
+	// the health check of the target, see tunnel.HealthCheckTCP
+	Health         string
+	HealthPath     string
+	HealthInterval time.Duration
+
+	// the other targets of the dialing side, besides the local address of
+	// a reverse tunnel or the remote address of a forward one
+	Targets       []string
+	TargetBalance string
+
+	// the limits of the channels, see tunnel.TunnelConfig
+	MaxConns    int
+	ConnQueue   int
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+// option define how to load an option of the URL form and how to format it
+type option struct {
+	parse  func(s *Spec, value string) error
+	format func(s *Spec) string // return "" if it is the default
+}
+
+var options = map[string]option{
+	"remote": {
+		parse: func(s *Spec, value string) error {
+			host, portS, err := net.SplitHostPort(value)
+			if err != nil {
+				return fmt.Errorf("should be host:port, IPv6 host should be like [::1]:22")
+			}
+			s.RemoteHost = host
+			s.RemotePort, err = s.parseRemotePorts(portS)
+			return err
+		},
+		// remote is always formatted first, see String
+		format: func(s *Spec) string { return "" },
+	},
+	"name": {
+		parse: func(s *Spec, value string) error {
+			if !nameRe.MatchString(value) {
+				return fmt.Errorf("only letters, digits, '_', '.' and '-' are allowed")
+			}
+			s.Name = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.Name },
+	},
+	"weight": {
+		parse: func(s *Spec, value string) (err error) {
+			s.Weight, err = parseWeight(value)
+			return
+		},
+		format: func(s *Spec) string { return formatInt(s.Weight) },
+	},
+	"upload": {
+		parse: func(s *Spec, value string) (err error) {
+			s.Upload, err = util.ParseSize(value)
+			return
+		},
+		format: func(s *Spec) string { return formatSize(s.Upload) },
+	},
+	"download": {
+		parse: func(s *Spec, value string) (err error) {
+			s.Download, err = util.ParseSize(value)
+			return
+		},
+		format: func(s *Spec) string { return formatSize(s.Download) },
+	},
+	"user": {
+		parse: func(s *Spec, value string) error {
+			if value == "" || len(value) > 255 {
+				return fmt.Errorf("should be 1-255 bytes")
+			}
+			s.User = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.User },
+	},
+	"password": {
+		parse: func(s *Spec, value string) error {
+			if len(value) > 255 {
+				return fmt.Errorf("should be at most 255 bytes")
+			}
+			s.Password = value
+			return nil
+		},
+		// keep the password out of logs
+		format: func(s *Spec) string { return "" },
+	},
+	"allow": {
+		parse: func(s *Spec, value string) (err error) {
+			s.Allow, err = esutil.ParseAllowList(value)
+			return
+		},
+		format: func(s *Spec) string { return s.Allow.String() },
+	},
+	"subdomain": {
+		parse: func(s *Spec, value string) error {
+			if !subdomainRe.MatchString(value) {
+				return fmt.Errorf("only letters, digits and '-' are allowed")
+			}
+			s.Subdomain = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.Subdomain },
+	},
+	"domain": {
+		parse: func(s *Spec, value string) error {
+			if !domainRe.MatchString(value) {
+				return fmt.Errorf("should be a domain name such as app.example.com")
+			}
+			s.Domain = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.Domain },
+	},
+	"service": {
+		parse: func(s *Spec, value string) error {
+			if !nameRe.MatchString(value) {
+				return fmt.Errorf("only letters, digits, '_', '.' and '-' are allowed")
+			}
+			s.Service = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.Service },
+	},
+	"secret": {
+		parse: func(s *Spec, value string) error {
+			if value == "" || len(value) > 255 {
+				return fmt.Errorf("should be 1-255 bytes")
+			}
+			s.Secret = value
+			return nil
+		},
+		// keep the secret out of logs
+		format: func(s *Spec) string { return "" },
+	},
+	"group": {
+		parse: func(s *Spec, value string) error {
+			if !nameRe.MatchString(value) {
+				return fmt.Errorf("only letters, digits, '_', '.' and '-' are allowed")
+			}
+			s.Group = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.Group },
+	},
+	"balance": {
+		parse: func(s *Spec, value string) error {
+			switch value {
+			case tunnel.BalanceRoundRobin, tunnel.BalanceLeastConn, tunnel.BalanceSource:
+				s.Balance = value
+				return nil
+			}
+			return fmt.Errorf("should be %s, %s or %s", tunnel.BalanceRoundRobin, tunnel.BalanceLeastConn, tunnel.BalanceSource)
+		},
+		format: func(s *Spec) string { return s.Balance },
+	},
+	"health": {
+		parse: func(s *Spec, value string) error {
+			if value != tunnel.HealthCheckTCP && value != tunnel.HealthCheckHTTP {
+				return fmt.Errorf("should be %s or %s", tunnel.HealthCheckTCP, tunnel.HealthCheckHTTP)
+			}
+			s.Health = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.Health },
+	},
+	"health-path": {
+		parse: func(s *Spec, value string) error {
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("should be a path such as /healthz")
+			}
+			s.HealthPath = value
+			return nil
+		},
+		format: func(s *Spec) string { return s.HealthPath },
+	},
+	"health-interval": {
+		parse: func(s *Spec, value string) (err error) {
+			if s.HealthInterval, err = time.ParseDuration(value); err == nil && s.HealthInterval < time.Second {
+				err = fmt.Errorf("should be at least 1s")
+			}
+			return
+		},
+		format: func(s *Spec) string { return formatDuration(s.HealthInterval) },
+	},
+	"targets": {
+		parse: func(s *Spec, value string) error {
+			s.Targets = nil
+			for _, addr := range strings.Split(value, ",") {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return fmt.Errorf("should be host:port separated by ',', IPv6 host should be like [::1]:22")
+				}
+				if _, err := parsePort(port); err != nil {
+					return err
+				}
+				s.Targets = append(s.Targets, net.JoinHostPort(host, port))
+			}
+			if len(s.Targets) > tunnel.MaxTargets {
+				return fmt.Errorf("should be at most %d targets", tunnel.MaxTargets)
+			}
+			return nil
+		},
+		format: func(s *Spec) string { return strings.Join(s.Targets, ",") },
+	},
+	"target-balance": {
+		parse: func(s *Spec, value string) error {
+			switch value {
+			case tunnel.BalanceRoundRobin, tunnel.BalanceRandom, tunnel.BalanceBackup:
+				s.TargetBalance = value
+				return nil
+			}
+			return fmt.Errorf("should be %s, %s or %s", tunnel.BalanceRoundRobin, tunnel.BalanceRandom, tunnel.BalanceBackup)
+		},
+		format: func(s *Spec) string { return s.TargetBalance },
+	},
+	"max-conns": {
+		parse: func(s *Spec, value string) (err error) {
+			s.MaxConns, err = parseCount(value)
+			return
+		},
+		format: func(s *Spec) string { return formatInt(s.MaxConns) },
+	},
+	"conn-queue": {
+		parse: func(s *Spec, value string) (err error) {
+			s.ConnQueue, err = parseCount(value)
+			return
+		},
+		format: func(s *Spec) string { return formatInt(s.ConnQueue) },
+	},
+	"idle-timeout": {
+		parse: func(s *Spec, value string) (err error) {
+			s.IdleTimeout, err = parseTimeout(value)
+			return
+		},
+		format: func(s *Spec) string { return formatDuration(s.IdleTimeout) },
+	},
+	"max-lifetime": {
+		parse: func(s *Spec, value string) (err error) {
+			s.MaxLifetime, err = parseTimeout(value)
+			return
+		},
+		format: func(s *Spec) string { return formatDuration(s.MaxLifetime) },
+	},
+	"burst": {
+		parse: func(s *Spec, value string) (err error) {
+			s.Burst, err = util.ParseSize(value)
+			return
+		},
+		format: func(s *Spec) string { return formatSize(s.Burst) },
+	},
+}
+
+// aliases are the other names of the options
+var aliases = map[string]string{
+	"maxconn": "max-conns",
+}
+
+func init() {
+	for _, name := range util.DialOptionNames {
+		name := name
+		options[name] = option{
+			parse:  func(s *Spec, value string) error { return util.SetDialOption(&s.Dial, name, value) },
+			format: func(s *Spec) string { return util.FormatDialOption(&s.Dial, name) },
+		}
+	}
+}
+
+// Parse parse a tunnel spec in URL form or legacy form
+func Parse(value string) (*Spec, error) {
+	if strings.Contains(value, "://") {
+		return parseURL(value)
+	}
+	return parseLegacy(value)
+}
+
+func parseURL(value string) (*Spec, error) {
+	s := &Spec{}
+	fail := func(field, v string, err error) (*Spec, error) {
+		return nil, &Error{Spec: value, Field: field, Value: v, Msg: err.Error()}
+	}
+
+	i := strings.Index(value, "://")
+	scheme, rest := value[:i], value[i+3:]
+	if err := s.setScheme(scheme); err != nil {
+		return fail("scheme", scheme, err)
+	}
+
+	authority, query := rest, ""
+	if i := strings.Index(rest, "?"); i >= 0 {
+		authority, query = rest[:i], rest[i+1:]
+	}
+	var err error
+	s.LocalHost, s.LocalPort, s.PortCount, err = splitHostPorts(authority)
+	if err != nil {
+		return fail("local address", authority, err)
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return fail("query", query, err)
+	}
+	names := []string{}
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	seen := map[string]bool{}
+	for _, k := range names {
+		name := k
+		if alias, ok := aliases[k]; ok {
+			name = alias
+		}
+		opt, ok := options[name]
+		if !ok {
+			return fail("option", k, fmt.Errorf("unknown option"))
+		}
+		if seen[name] || len(values[k]) > 1 {
+			return fail("option", k, fmt.Errorf("duplicate option"))
+		}
+		seen[name] = true
+		v := values[k][0]
+		if err := opt.parse(s, v); err != nil {
+			return fail(k, v, err)
+		}
+	}
+	for _, name := range util.DialOptionNames {
+		if seen[name] && !s.Reverse {
+			return fail("option", name, fmt.Errorf("only a reverse tunnel dials on this side, the server dials with its own options"))
+		}
+	}
+	if !s.shared() && (seen["subdomain"] || seen["domain"]) {
+		return fail("option", "subdomain", fmt.Errorf("only an http or tls tunnel has the host names"))
+	}
+	if !s.service() && (seen["service"] || (seen["secret"] && !seen["group"])) {
+		return fail("option", "service", fmt.Errorf("only an stcp tunnel has the service"))
+	}
+	if seen["balance"] && !seen["group"] {
+		return fail("group", "", fmt.Errorf("group option is required with balance"))
+	}
+	if seen["group"] && (s.Dynamic || !s.Reverse || s.Proto != "tcp" || s.PortCount > 0) {
+		return fail("option", "group", fmt.Errorf("only a reverse tcp tunnel of one port can join a group"))
+	}
+	if (seen["health-path"] || seen["health-interval"]) && !seen["health"] {
+		return fail("health", "", fmt.Errorf("health option is required with health-path and health-interval"))
+	}
+	if seen["health-path"] && s.Health != tunnel.HealthCheckHTTP {
+		return fail("option", "health-path", fmt.Errorf("only an http health check has the path"))
+	}
+	if seen["health"] && (s.Dynamic || s.Proto == "udp" || s.PortCount > 0 || (s.service() && !s.Reverse)) {
+		return fail("option", "health", fmt.Errorf("only a tcp, http, tls or stcp tunnel of one port can have health check"))
+	}
+	if seen["target-balance"] && !seen["targets"] {
+		return fail("targets", "", fmt.Errorf("targets option is required with target-balance"))
+	}
+	if seen["targets"] && (s.Dynamic || s.PortCount > 0 || (s.service() && !s.Reverse)) {
+		return fail("option", "targets", fmt.Errorf("only a tunnel of one port can have other targets"))
+	}
+	if seen["conn-queue"] && !seen["max-conns"] {
+		return fail("max-conns", "", fmt.Errorf("max-conns option is required with conn-queue"))
+	}
+	if seen["conn-queue"] && s.Proto == "udp" {
+		return fail("option", "conn-queue", fmt.Errorf("the datagrams of udp tunnel can not be queued"))
+	}
+	if s.PortCount > 0 && (s.Dynamic || s.shared() || s.service()) {
+		return fail("local address", authority, fmt.Errorf("only a tcp or udp tunnel can have a port range"))
+	}
+	if s.Dynamic {
+		if seen["remote"] {
+			return fail("remote", "", fmt.Errorf("a dynamic tunnel has no remote address"))
+		}
+		if s.Proto != "tcp" && s.Proto != "http" {
+			return fail("proto", s.Proto, fmt.Errorf("a dynamic tunnel must be tcp (SOCKS5) or http (HTTP proxy)"))
+		}
+		if seen["password"] && !seen["user"] {
+			return fail("user", "", fmt.Errorf("user option is required with password"))
+		}
+		return s, nil
+	}
+	if seen["user"] || seen["password"] {
+		return fail("option", "user", fmt.Errorf("only a dynamic tunnel has the proxy auth"))
+	}
+	if seen["allow"] {
+		return fail("option", "allow", fmt.Errorf("only a dynamic tunnel has the allowed destinations"))
+	}
+	if s.shared() {
+		if !s.Reverse {
+			return fail("scheme", scheme, fmt.Errorf("an %s tunnel must be reverse", s.Proto))
+		}
+		if seen["remote"] {
+			return fail("remote", "", fmt.Errorf("an %s tunnel is served on the shared port of server, it has no remote address", s.Proto))
+		}
+		if !seen["subdomain"] && !seen["domain"] {
+			return fail("subdomain", "", fmt.Errorf("subdomain or domain option is required"))
+		}
+		return s, nil
+	}
+	if s.service() {
+		if seen["remote"] {
+			return fail("remote", "", fmt.Errorf("an stcp tunnel is relayed by server, it has no remote address"))
+		}
+		if !seen["service"] || !seen["secret"] {
+			return fail("service", "", fmt.Errorf("service and secret options are required"))
+		}
+		return s, nil
+	}
+	if !seen["remote"] {
+		return fail("remote", "", fmt.Errorf("remote option is required"))
+	}
+	if seen["group"] && s.RemotePort == 0 {
+		return fail("remote", joinHostPorts(s.RemoteHost, s.RemotePort, 0), fmt.Errorf("a tunnel group should have a fixed port"))
+	}
+	if seen["group"] && !seen["secret"] {
+		return fail("secret", "", fmt.Errorf("secret option is required with group"))
+	}
+
+	return s, nil
+}
+
+func parseLegacy(value string) (*Spec, error) {
+	fail := func(field, v string, err error) (*Spec, error) {
+		return nil, &Error{Spec: value, Field: field, Value: v, Msg: err.Error()}
+	}
+
+	L, err := splitLegacy(value)
+	if err != nil {
+		return fail("spec", value, err)
+	}
+
+	if L[0] == "d" || L[0] == "D" {
+		return parseLegacyDynamic(value, L)
+	}
+
+	// !IMPORTANT! support old configure
+	if len(L) == 5 {
+		L = append([]string{L[0], "tcp"}, L[1:]...)
+	}
+
+	if len(L) != 6 && len(L) != 7 {
+		return fail("spec", value, fmt.Errorf("should be %q or %q", LegacyFormat, URLFormat))
+	}
+
+	s := &Spec{}
+	if err := s.setKind(L[0]); err != nil {
+		return fail("tunnel type", L[0], err)
+	}
+	if err := s.setProto(L[1]); err != nil {
+		return fail("proto", L[1], err)
+	}
+	if s.shared() || s.service() {
+		return fail("proto", L[1], fmt.Errorf("an %s tunnel is supported in URL form only", s.Proto))
+	}
+	s.LocalHost = unbracket(L[2])
+	if s.LocalPort, s.PortCount, err = parsePorts(L[3]); err != nil {
+		return fail("local port", L[3], err)
+	}
+	s.RemoteHost = unbracket(L[4])
+	if s.RemotePort, err = s.parseRemotePorts(L[5]); err != nil {
+		return fail("remote port", L[5], err)
+	}
+	if len(L) == 7 && L[6] != "" {
+		if s.Weight, err = parseWeight(L[6]); err != nil {
+			return fail("weight", L[6], err)
+		}
+	}
+
+	return s, nil
+}
+
+// parseLegacyDynamic parse "d:[bind:]port"
+func parseLegacyDynamic(value string, L []string) (*Spec, error) {
+	fail := func(field, v string, err error) (*Spec, error) {
+		return nil, &Error{Spec: value, Field: field, Value: v, Msg: err.Error()}
+	}
+
+	s := &Spec{Dynamic: true, Proto: "tcp", LocalHost: defaultDynamicBind}
+	switch len(L) {
+	case 2:
+	case 3:
+		s.LocalHost = unbracket(L[1])
+	default:
+		return fail("spec", value, fmt.Errorf("should be d:[bind:]port"))
+	}
+	port := L[len(L)-1]
+	var err error
+	if s.LocalPort, err = parsePort(port); err != nil {
+		return fail("local port", port, err)
+	}
+	return s, nil
+}
+
+// splitLegacy split the legacy form by ':', but not in brackets
+func splitLegacy(value string) ([]string, error) {
+	L := []string{}
+	depth, start := 0, 0
+	for i, c := range value {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unmatched ']' at %d", i)
+			}
+		case ':':
+			if depth == 0 {
+				L = append(L, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unmatched '['")
+	}
+	return append(L, value[start:]), nil
+}
+
+func (s *Spec) setScheme(scheme string) error {
+	kind, proto := scheme, "tcp"
+	if i := strings.Index(scheme, "+"); i >= 0 {
+		kind, proto = scheme[:i], scheme[i+1:]
+	}
+	if err := s.setKind(kind); err != nil {
+		return err
+	}
+	return s.setProto(proto)
+}
+
+func (s *Spec) setKind(kind string) error {
+	switch kind {
+	case "r", "R":
+		s.Reverse = true
+	case "f", "F":
+		s.Reverse = false
+	case "d", "D":
+		s.Dynamic = true
+	default:
+		return fmt.Errorf("should be r (reverse), f (forward) or d (dynamic)")
+	}
+	return nil
+}
+
+func (s *Spec) setProto(proto string) error {
+	proto = strings.TrimSpace(strings.ToLower(proto))
+	if proto == "" {
+		proto = "tcp"
+	}
+	if !(proto == "tcp" || proto == "udp" || proto == "http" || proto == "tls" || proto == "stcp") {
+		return fmt.Errorf("unknown protocol, should be tcp, udp, http, tls or stcp")
+	}
+	s.Proto = proto
+	return nil
+}
+
+// AssignPort tell whether the remote port is assigned by server
+func (s *Spec) AssignPort() bool {
+	return s.Reverse && !s.shared() && !s.service() && s.RemotePort == 0
+}
+
+// shared tell whether the tunnel is served on a shared port of server
+func (s *Spec) shared() bool {
+	return !s.Dynamic && (s.Proto == "http" || s.Proto == "tls")
+}
+
+// service tell whether the tunnel is an stcp service or its visitor
+func (s *Spec) service() bool {
+	return !s.Dynamic && s.Proto == "stcp"
+}
+
+// splitHostPorts split host:port or host:port-port, count is 0 for one
+// port
+func splitHostPorts(addr string) (host string, port, count int, err error) {
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("should be host:port, IPv6 host should be like [::1]:22")
+	}
+	if port, count, err = parsePorts(portS); err != nil {
+		return "", 0, 0, err
+	}
+	return host, port, count, nil
+}
+
+// parsePorts parse a port or a range of ports such as 30000-30100, count is
+// 0 for one port
+func parsePorts(value string) (port, count int, err error) {
+	i := strings.Index(value, "-")
+	if i < 0 {
+		port, err = parsePort(value)
+		return port, 0, err
+	}
+	if port, err = parsePort(value[:i]); err != nil {
+		return
+	}
+	last, err := parsePort(value[i+1:])
+	if err != nil {
+		return
+	}
+	if last < port {
+		return 0, 0, fmt.Errorf("the range should be first-last")
+	}
+	if count = last - port + 1; count > tunnel.MaxPortCount {
+		return 0, 0, fmt.Errorf("the range should have at most %d ports", tunnel.MaxPortCount)
+	}
+	if count == 1 {
+		count = 0
+	}
+	return port, count, nil
+}
+
+// parseRemotePorts parse the remote port or range, which has the size of
+// the local one. Port 0 asks server to assign a port to a reverse tunnel.
+func (s *Spec) parseRemotePorts(value string) (int, error) {
+	if value == "0" {
+		if !s.Reverse || s.PortCount > 0 {
+			return 0, fmt.Errorf("only a reverse tunnel of one port can ask server to assign the port")
+		}
+		return 0, nil
+	}
+	port, count, err := parsePorts(value)
+	if err != nil {
+		return 0, err
+	}
+	if count != s.PortCount {
+		return 0, fmt.Errorf("should be a range of the same size as the local ports")
+	}
+	return port, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("port should be an integer in 1-65535")
+	}
+	return port, nil
+}
+
+func parseWeight(value string) (int, error) {
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight <= 0 {
+		return 0, fmt.Errorf("weight should be a positive integer")
+	}
+	return weight, nil
+}
+
+func parseCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("should be a positive integer")
+	}
+	return n, nil
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("should be at least 1s")
+	}
+	return d, nil
+}
+
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// joinHostPorts format host:port or host:port-port
+func joinHostPorts(host string, port, count int) string {
+	if count == 0 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return net.JoinHostPort(host, fmt.Sprintf("%d-%d", port, port+count-1))
+}
+
+// queryEscaper escape the characters which have a meaning in the query,
+// the others are kept for the logs
+var queryEscaper = strings.NewReplacer("%", "%25", "&", "%26", "=", "%3D", "+", "%2B", ";", "%3B", "#", "%23", " ", "%20")
+
+func formatInt(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func formatSize(v int64) string {
+	if v == 0 {
+		return ""
+	}
+	return util.FormatSize(v)
+}
+
+// String format the spec in URL form, Parse(s.String()) returns the same
+// spec except the password and secret
+func (s *Spec) String() string {
+	kind := "f"
+	if s.Reverse {
+		kind = "r"
+	}
+
+	b := &strings.Builder{}
+	sep := "&"
+	if s.Dynamic {
+		fmt.Fprintf(b, "d+%s://%s", s.Proto, net.JoinHostPort(s.LocalHost, strconv.Itoa(s.LocalPort)))
+		sep = "?"
+	} else if s.shared() || s.service() {
+		fmt.Fprintf(b, "%s+%s://%s", kind, s.Proto, net.JoinHostPort(s.LocalHost, strconv.Itoa(s.LocalPort)))
+		sep = "?"
+	} else {
+		fmt.Fprintf(b, "%s+%s://%s?remote=%s", kind, s.Proto,
+			joinHostPorts(s.LocalHost, s.LocalPort, s.PortCount),
+			joinHostPorts(s.RemoteHost, s.RemotePort, s.PortCount))
+	}
+
+	keys := []string{}
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := options[k].format(s); v != "" {
+			fmt.Fprintf(b, "%s%s=%s", sep, k, queryEscaper.Replace(v))
+			sep = "&"
+		}
+	}
+	return b.String()
+}
+
+// TunnelConfig convert the spec to the config of es tunnel
+func (s *Spec) TunnelConfig() *tunnel.TunnelConfig {
+	cfg := &tunnel.TunnelConfig{
+		Proto:      s.Proto,
+		LocalHost:  s.LocalHost,
+		LocalPort:  s.LocalPort,
+		RemoteHost: s.RemoteHost,
+		RemotePort: s.RemotePort,
+		PortCount:  s.PortCount,
+		Reverse:    s.Reverse,
+		Dynamic:    s.Dynamic,
+		Subdomain:  s.Subdomain,
+		Domain:     s.Domain,
+		Service:    s.Service,
+		Secret:     s.Secret,
+		Visitor:    s.service() && !s.Reverse,
+		Group:      s.Group,
+		Balance:    s.Balance,
+		Name:       s.Name,
+		Weight:     s.Weight,
+		Upload:     s.Upload,
+		Download:   s.Download,
+		Burst:      s.Burst,
+
+		HealthCheck:    s.Health,
+		HealthPath:     s.HealthPath,
+		HealthInterval: s.HealthInterval,
+
+		Targets:       s.Targets,
+		TargetBalance: s.TargetBalance,
+
+		MaxConns:    s.MaxConns,
+		ConnQueue:   s.ConnQueue,
+		IdleTimeout: s.IdleTimeout,
+		MaxLifetime: s.MaxLifetime,
+	}
+	if s.Dynamic {
+		// the proto of a dynamic tunnel is the proxy protocol, the channels
+		// are tcp
+		cfg.Proto = "tcp"
+		cfg.HTTPProxy = s.Proto == "http"
+		cfg.ProxyUser, cfg.ProxyPassword = s.User, s.Password
+		cfg.Allow = s.Allow
+	}
+	if s.Dial != (esutil.DialOptions{}) {
+		dial := s.Dial
+		cfg.Dial = &dial
+	}
+	return cfg
+}
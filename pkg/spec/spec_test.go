@@ -0,0 +1,191 @@
+package spec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	esutil "github.com/ooclab/es/util"
+)
+
+func mustAllow(s string) esutil.AllowList {
+	l, err := esutil.ParseAllowList(s)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+var validSpecs = []struct {
+	in   string
+	want Spec
+}{
+	// legacy form
+	{"r:tcp:127.0.0.1:22::50022", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 22, RemotePort: 50022}},
+	{"f:127.0.0.1:3128:0.0.0.0:20080", Spec{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 3128, RemoteHost: "0.0.0.0", RemotePort: 20080}},
+	{"R:UDP:127.0.0.1:53::5353:2", Spec{Reverse: true, Proto: "udp", LocalHost: "127.0.0.1", LocalPort: 53, RemotePort: 5353, Weight: 2}},
+	{"r:tcp:[::1]:22:[::]:50022", Spec{Reverse: true, Proto: "tcp", LocalHost: "::1", LocalPort: 22, RemoteHost: "::", RemotePort: 50022}},
+	{"r:tcp:127.0.0.1:30000-30100::40000-40100", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 30000, RemotePort: 40000, PortCount: 101}},
+	{"r:tcp:127.0.0.1:22::0", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 22}},
+	{"d:1080", Spec{Dynamic: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 1080}},
+	{"d:[::]:1080", Spec{Dynamic: true, Proto: "tcp", LocalHost: "::", LocalPort: 1080}},
+
+	// URL form
+	{"r+tcp://[::1]:22?remote=[::]:50022&name=ssh&maxconn=20", Spec{Reverse: true, Proto: "tcp", LocalHost: "::1", LocalPort: 22, RemoteHost: "::", RemotePort: 50022, Name: "ssh", MaxConns: 20}},
+	{"f://:20080?remote=127.0.0.1:3128&weight=3", Spec{Proto: "tcp", LocalPort: 20080, RemoteHost: "127.0.0.1", RemotePort: 3128, Weight: 3}},
+	{"r+udp://127.0.0.1:5000-5009?remote=:45000-45009", Spec{Reverse: true, Proto: "udp", LocalHost: "127.0.0.1", LocalPort: 5000, RemotePort: 45000, PortCount: 10}},
+	{"r+tcp://127.0.0.1:22?remote=:0", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 22}},
+	{"d+http://127.0.0.1:3128?user=alice&password=a%26b%3Dc%25", Spec{Dynamic: true, Proto: "http", LocalHost: "127.0.0.1", LocalPort: 3128, User: "alice", Password: "a&b=c%"}},
+	{"d://127.0.0.1:1080?allow=*.example.com,10.0.0.0/8:22", Spec{Dynamic: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 1080, Allow: mustAllow("*.example.com,10.0.0.0/8:22")}},
+	{"r+http://127.0.0.1:8080?subdomain=app1&domain=app.example.com", Spec{Reverse: true, Proto: "http", LocalHost: "127.0.0.1", LocalPort: 8080, Subdomain: "app1", Domain: "app.example.com"}},
+	{"r+tls://127.0.0.1:8443?domain=secure.example.com", Spec{Reverse: true, Proto: "tls", LocalHost: "127.0.0.1", LocalPort: 8443, Domain: "secure.example.com"}},
+	{"f+stcp://127.0.0.1:2222?service=ssh&secret=s3cr3t", Spec{Proto: "stcp", LocalHost: "127.0.0.1", LocalPort: 2222, Service: "ssh", Secret: "s3cr3t"}},
+	{"r+tcp://127.0.0.1:80?remote=:8080&group=web&secret=s3cr3t&balance=least-conn", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 80, RemotePort: 8080, Group: "web", Secret: "s3cr3t", Balance: "least-conn"}},
+	{"r+tcp://127.0.0.1:80?remote=:8080&health=http&health-path=/healthz%3Fa%3D1%26b%3D2&health-interval=5s", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 80, RemotePort: 8080, Health: "http", HealthPath: "/healthz?a=1&b=2", HealthInterval: 5 * time.Second}},
+	{"r+tcp://10.0.0.1:80?remote=:8080&targets=10.0.0.2:80,[::1]:80&target-balance=backup", Spec{Reverse: true, Proto: "tcp", LocalHost: "10.0.0.1", LocalPort: 80, RemotePort: 8080, Targets: []string{"10.0.0.2:80", "[::1]:80"}, TargetBalance: "backup"}},
+	{"r+tcp://127.0.0.1:80?remote=:8080&max-conns=100&conn-queue=20&idle-timeout=5m&max-lifetime=24h", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 80, RemotePort: 8080, MaxConns: 100, ConnQueue: 20, IdleTimeout: 5 * time.Minute, MaxLifetime: 24 * time.Hour}},
+	{"f://127.0.0.1:8080?remote=:80&upload=512K&download=1.5M&burst=1M", Spec{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 8080, RemotePort: 80, Upload: 512 << 10, Download: 3 << 19, Burst: 1 << 20}},
+	{"r://127.0.0.1:80?remote=:8080&bind=[fe80::1%25eth0]:0&nodelay=false&tcp-keepalive=off&user-timeout=30s&mark=0x64", Spec{Reverse: true, Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 80, RemotePort: 8080, Dial: esutil.DialOptions{LocalAddr: "[fe80::1%eth0]:0", NoDelay: new(bool), KeepAlive: -1, UserTimeout: 30 * time.Second, Mark: 100}}},
+}
+
+func Test_Parse(t *testing.T) {
+	for _, c := range validSpecs {
+		s, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("%s: %s", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(*s, c.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.in, *s, c.want)
+		}
+	}
+}
+
+func Test_Parse_EveryOption(t *testing.T) {
+	for name := range options {
+		found := false
+		for _, c := range validSpecs {
+			if strings.Contains(c.in, "?"+name+"=") || strings.Contains(c.in, "&"+name+"=") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("option %s is not tested", name)
+		}
+	}
+}
+
+func Test_Parse_String(t *testing.T) {
+	for _, c := range validSpecs {
+		s, err := Parse(c.in)
+		if err != nil {
+			continue
+		}
+		// the password and secret are never formatted
+		want := *s
+		want.Password, want.Secret = "", ""
+
+		formatted := s.String()
+		if strings.Contains(formatted, "s3cr3t") || (s.Password != "" && strings.Contains(formatted, "password=")) {
+			t.Errorf("%s: the secret is formatted in %s", c.in, formatted)
+		}
+		got, err := Parse(formatted)
+		if err != nil {
+			// a group or service can not be parsed without its secret
+			if s.Secret != "" {
+				continue
+			}
+			t.Errorf("%s: parse %s: %s", c.in, formatted, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: %s is parsed as\n %+v\nwant %+v", c.in, formatted, *got, want)
+		}
+	}
+}
+
+func Test_Parse_Error(t *testing.T) {
+	for _, c := range []struct {
+		in, field, value string
+	}{
+		{"x:tcp:127.0.0.1:22::50022", "tunnel type", "x"},
+		{"r:tcp:127.0.0.1:0::50022", "local port", "0"},
+		{"r:tcp:127.0.0.1:22::70000", "remote port", "70000"},
+		{"r:tcp:[::1:22::50022", "spec", "r:tcp:[::1:22::50022"},
+		{"r:tcp:127.0.0.1:22", "spec", "r:tcp:127.0.0.1:22"},
+		{"r:http:127.0.0.1:80::8080", "proto", "http"},
+		{"d:a:b:1080", "spec", "d:a:b:1080"},
+		{"x+tcp://127.0.0.1:22?remote=:1", "scheme", "x+tcp"},
+		{"r+sctp://127.0.0.1:22?remote=:1", "scheme", "r+sctp"},
+		{"r+tcp://127.0.0.1?remote=:1", "local address", "127.0.0.1"},
+		{"r+tcp://::1:22?remote=:1", "local address", "::1:22"},
+		{"r+tcp://127.0.0.1:22", "remote", ""},
+		{"r+tcp://127.0.0.1:22?remote=::1:22", "remote", "::1:22"},
+		{"r+tcp://127.0.0.1:30000-30001?remote=:1", "remote", ":1"},
+		{"f+tcp://127.0.0.1:22?remote=:0", "remote", ":0"},
+		{"r+tcp://127.0.0.1:22?remote=:1&foo=1", "option", "foo"},
+		{"r+tcp://127.0.0.1:22?remote=:1&name=a&name=b", "option", "name"},
+		{"r+tcp://127.0.0.1:22?remote=:1&maxconn=1&max-conns=2", "option", "maxconn"},
+		{"r+tcp://127.0.0.1:22?remote=:1&name=%zz", "query", "remote=:1&name=%zz"},
+		{"r+tcp://127.0.0.1:22?remote=:1&name=a%20b", "name", "a b"},
+		{"r+tcp://127.0.0.1:22?remote=:1&weight=0", "weight", "0"},
+		{"r+tcp://127.0.0.1:22?remote=:1&upload=fast", "upload", "fast"},
+		{"r+tcp://127.0.0.1:22?remote=:1&idle-timeout=10ms", "idle-timeout", "10ms"},
+		{"r+tcp://127.0.0.1:22?remote=:1&mark=0", "mark", "0"},
+		{"f+tcp://127.0.0.1:22?remote=:1&bind=10.0.0.1", "option", "bind"},
+		{"r+tcp://127.0.0.1:22?remote=:1&secret=s3cr3t", "option", "service"},
+		{"r+tcp://127.0.0.1:22?remote=:1&balance=source", "group", ""},
+		{"r+tcp://127.0.0.1:22?remote=:1&group=web", "secret", ""},
+		{"f+tcp://127.0.0.1:22?remote=:1&group=web&secret=s3cr3t", "option", "group"},
+		{"r+tcp://127.0.0.1:22?remote=:1&health-path=/", "health", ""},
+		{"r+tcp://127.0.0.1:22?remote=:1&health=tcp&health-path=/", "option", "health-path"},
+		{"r+tcp://127.0.0.1:22?remote=:1&target-balance=backup", "targets", ""},
+		{"r+tcp://127.0.0.1:22?remote=:1&conn-queue=1", "max-conns", ""},
+		{"r+udp://127.0.0.1:22?remote=:1&max-conns=1&conn-queue=1", "option", "conn-queue"},
+		{"d://127.0.0.1:1080?remote=:1", "remote", ""},
+		{"d+udp://127.0.0.1:1080", "proto", "udp"},
+		{"d://127.0.0.1:1080?password=p", "user", ""},
+		{"r+tcp://127.0.0.1:22?remote=:1&user=alice", "option", "user"},
+		{"r+http://127.0.0.1:80?remote=:1&subdomain=app", "remote", ""},
+		{"r+http://127.0.0.1:80", "subdomain", ""},
+		{"f+http://127.0.0.1:80?subdomain=app", "scheme", "f+http"},
+		{"r+stcp://127.0.0.1:22?service=ssh", "service", ""},
+	} {
+		_, err := Parse(c.in)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: got %v, expect a spec error", c.in, err)
+			continue
+		}
+		if e.Spec != c.in || e.Field != c.field || e.Value != c.value {
+			t.Errorf("%s: got field %q value %q (%s), expect %q %q", c.in, e.Field, e.Value, e.Msg, c.field, c.value)
+		}
+	}
+}
+
+func Test_parsePorts(t *testing.T) {
+	for _, c := range []struct {
+		in          string
+		port, count int
+		ok          bool
+	}{
+		{"22", 22, 0, true},
+		{"30000-30100", 30000, 101, true},
+		{"22-22", 22, 0, true},
+		{"64512-65535", 64512, 1024, true},
+		{"64511-65535", 0, 0, false},
+		{"10-5", 0, 0, false},
+		{"0-10", 0, 0, false},
+		{"65535-65536", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"1-", 0, 0, false},
+		{"-", 0, 0, false},
+	} {
+		port, count, err := parsePorts(c.in)
+		if (err == nil) != c.ok || c.ok && (port != c.port || count != c.count) {
+			t.Errorf("%q: got %d, %d, %v", c.in, port, count, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	esutil "github.com/ooclab/es/util"
+)
+
+// DialOptionNames are the names of the socket options, they are the same
+// in the command flags and the tunnel spec
+var DialOptionNames = []string{"bind", "nodelay", "tcp-keepalive", "user-timeout", "mark"}
+
+// SetDialOption parse the value of the socket option name into o
+func SetDialOption(o *esutil.DialOptions, name, value string) error {
+	switch name {
+	case "bind":
+		host := value
+		if h, _, err := net.SplitHostPort(value); err == nil {
+			host = h
+		}
+		if i := strings.Index(host, "%"); i >= 0 {
+			host = host[:i]
+		}
+		if net.ParseIP(strings.Trim(host, "[]")) == nil {
+			return fmt.Errorf("should be an IP or IP:port, such as 192.168.1.2 or [::1]:0")
+		}
+		o.LocalAddr = value
+	case "nodelay":
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("should be true or false")
+		}
+		o.NoDelay = &v
+	case "tcp-keepalive":
+		if value == "off" {
+			o.KeepAlive = -1
+			return nil
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("should be a positive duration such as 30s, or off")
+		}
+		o.KeepAlive = v
+	case "user-timeout":
+		v, err := time.ParseDuration(value)
+		if err != nil || v < time.Millisecond {
+			return fmt.Errorf("should be a duration such as 30s")
+		}
+		o.UserTimeout = v
+	case "mark":
+		v, err := strconv.ParseUint(value, 0, 32)
+		if err != nil || v == 0 {
+			return fmt.Errorf("should be a positive integer, such as 100 or 0x64")
+		}
+		o.Mark = int(v)
+	default:
+		return fmt.Errorf("unknown socket option")
+	}
+	return nil
+}
+
+// FormatDialOption format the socket option name of o in the form
+// SetDialOption accept, return "" if it is not set
+func FormatDialOption(o *esutil.DialOptions, name string) string {
+	switch name {
+	case "bind":
+		return o.LocalAddr
+	case "nodelay":
+		if o.NoDelay != nil {
+			return strconv.FormatBool(*o.NoDelay)
+		}
+	case "tcp-keepalive":
+		if o.KeepAlive < 0 {
+			return "off"
+		} else if o.KeepAlive > 0 {
+			return o.KeepAlive.String()
+		}
+	case "user-timeout":
+		if o.UserTimeout > 0 {
+			return o.UserTimeout.String()
+		}
+	case "mark":
+		if o.Mark != 0 {
+			return strconv.Itoa(o.Mark)
+		}
+	}
+	return ""
+}
+
+// ParseDialOptions load the socket options by get, which return the value
+// of a name or "". It returns nil if none is set.
+func ParseDialOptions(get func(name string) string) (*esutil.DialOptions, error) {
+	o := &esutil.DialOptions{}
+	set := false
+	for _, name := range DialOptionNames {
+		value := get(name)
+		if value == "" {
+			continue
+		}
+		if err := SetDialOption(o, name, value); err != nil {
+			return nil, fmt.Errorf("--%s %q: %s", name, value, err)
+		}
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return o, nil
+}
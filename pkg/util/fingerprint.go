@@ -0,0 +1,31 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const fingerprintScheme = "sha256:"
+
+// CertFingerprint return the fingerprint of a DER certificate, such as
+// "sha256:6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return fingerprintScheme + hex.EncodeToString(sum[:])
+}
+
+// ParseFingerprint normalize a fingerprint in the form of CertFingerprint,
+// the hex digits can be upper case and separated by ':'
+func ParseFingerprint(value string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	if !strings.HasPrefix(s, fingerprintScheme) {
+		return "", fmt.Errorf("fingerprint %q should start with %q", value, fingerprintScheme)
+	}
+	s = strings.Replace(strings.TrimPrefix(s, fingerprintScheme), ":", "", -1)
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("fingerprint %q should be %d bytes in hex", value, sha256.Size)
+	}
+	return fingerprintScheme + s, nil
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// ParseSize parse a size like "512K", "1.5M" or "100" (bytes), the units
+// are 1024 based, an optional "B" or "iB" suffix is allowed. An empty
+// value is 0.
+func ParseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.size
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q, should be like 100, 512K, 1.5M or 1G", value)
+	}
+	return int64(v * float64(unit)), nil
+}
+
+// FormatSize format a size in the shortest form ParseSize accept
+func FormatSize(size int64) string {
+	for _, u := range sizeUnits {
+		if size >= u.size && size%u.size == 0 {
+			return strconv.FormatInt(size/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
@@ -10,7 +10,11 @@ var (
 	salt = []byte("otunnel")
 )
 
+// GenSecret derive the key from secret, nil if secret is empty
 func GenSecret(secret string, keyiter int, keylen int) []byte {
+	if secret == "" {
+		return nil
+	}
 	if keyiter == 0 {
 		keyiter = int(secret[0])
 	}
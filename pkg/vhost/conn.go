@@ -0,0 +1,32 @@
+package vhost
+
+import (
+	"bytes"
+	"io"
+	"net"
+)
+
+// peekedConn is a conn with the bytes read for routing put back
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newPeekedConn(conn net.Conn, peeked []byte) *peekedConn {
+	return &peekedConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite keep the half-close of the underlying conn
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
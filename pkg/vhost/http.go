@@ -0,0 +1,114 @@
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHeaderSize is the max bytes of the first request header
+const maxHeaderSize = 64 * 1024
+
+const notFoundPage = `<!DOCTYPE html>
+<html>
+<head><title>404 Not Found</title></head>
+<body>
+<h1>404 Not Found</h1>
+<p>No tunnel is serving %s.</p>
+</body>
+</html>
+`
+
+// NewHTTP return the router of the HTTP virtual hosts, the connections are
+// routed by the Host header of their first request. The first request is
+// sent with "Connection: close", so the next ones come in new connections
+// and are routed again, unless it is an upgrade such as WebSocket. The
+// subdomains of the tunnels are under domain.
+func NewHTTP(domain string) *Router {
+	r := newRouter("http", domain)
+	r.peek = peekHTTP
+	r.reject = rejectHTTP
+	return r
+}
+
+func peekHTTP(conn net.Conn) (string, []byte, error) {
+	peeked := &bytes.Buffer{}
+	br := bufio.NewReader(io.TeeReader(io.LimitReader(conn, maxHeaderSize), peeked))
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", peeked.Bytes(), err
+	}
+	if isUpgrade(req) {
+		return req.Host, peeked.Bytes(), nil
+	}
+	return req.Host, setConnectionClose(peeked.Bytes()), nil
+}
+
+// isUpgrade tell whether the request asks to switch the protocol
+func isUpgrade(req *http.Request) bool {
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setConnectionClose replace the connection headers in the request head
+// at the start of b by "Connection: close", the bytes after the head are
+// kept
+func setConnectionClose(b []byte) []byte {
+	head := &bytes.Buffer{}
+	rest := b
+	for first := true; ; first = false {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			// not reached, the head is parsed already
+			return b
+		}
+		line := rest[:i+1]
+		rest = rest[i+1:]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			head.WriteString("Connection: close\r\n")
+			head.Write(line)
+			break
+		}
+		if !first && isConnectionHeader(line) {
+			continue
+		}
+		head.Write(line)
+	}
+	return append(head.Bytes(), rest...)
+}
+
+func isConnectionHeader(line []byte) bool {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return false
+	}
+	switch strings.ToLower(string(bytes.TrimSpace(line[:i]))) {
+	case "connection", "keep-alive", "proxy-connection":
+		return true
+	}
+	return false
+}
+
+func rejectHTTP(conn net.Conn, peeked []byte, host string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(peekTimeout))
+	status, body := "400 Bad Request", "Bad Request\n"
+	if host != "" {
+		status = "404 Not Found"
+		body = fmt.Sprintf(notFoundPage, html.EscapeString(normalizeHost(host)))
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, len(body), body)
+}
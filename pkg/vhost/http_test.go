@@ -0,0 +1,89 @@
+package vhost
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ooclab/es/tunnel"
+)
+
+func Test_Router_HTTP(t *testing.T) {
+	r := NewHTTP("tunnel.example.com")
+	m, out := newTestManager(r, "http")
+	app1, err := m.TunnelCreate(&tunnel.TunnelConfig{Proto: "http", Subdomain: "app1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app2, err := m.TunnelCreate(&tunnel.TunnelConfig{Proto: "http", Domain: "app.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, expect := range map[string]uint32{
+		"app1.tunnel.example.com":     app1.ID,
+		"App.Example.org:8080":        app2.ID,
+		"app1.tunnel.example.com.:80": app1.ID,
+	} {
+		conn := dialRouter(r)
+		path := "/" + strings.Replace(host, ":", "_", -1)
+		go fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive\r\nKeep-Alive: timeout=5\r\n\r\n", path, host)
+		// the routed request closes the connection
+		routed := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, host)
+		if tid := out.wait(t, routed); tid != expect {
+			t.Errorf("%s is routed to tunnel %d, expect %d", host, tid, expect)
+		}
+		conn.Close()
+	}
+
+	// unknown host and bad request
+	for request, status := range map[string]int{
+		"GET / HTTP/1.1\r\nHost: nobody.tunnel.example.com\r\n\r\n": http.StatusNotFound,
+		"NOT HTTP\r\n\r\n": http.StatusBadRequest,
+	} {
+		conn := dialRouter(r)
+		go conn.Write([]byte(request))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Errorf("%q: got %s, expect %d", request, resp.Status, status)
+		}
+		if status == http.StatusNotFound && !strings.Contains(string(body), "nobody.tunnel.example.com") {
+			t.Errorf("the 404 page does not name the host: %s", body)
+		}
+		conn.Close()
+	}
+}
+
+func Test_setConnectionClose(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{
+			"GET / HTTP/1.1\r\nHost: a\r\nConnection: keep-alive\r\nKeep-Alive: timeout=5\r\n\r\nGET /next HTTP/1.1\r\n",
+			"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\nGET /next HTTP/1.1\r\n",
+		},
+		{
+			"POST / HTTP/1.0\nhost: a\nproxy-connection: keep-alive\n\nbody",
+			"POST / HTTP/1.0\nhost: a\nConnection: close\r\n\nbody",
+		},
+	} {
+		if got := string(setConnectionClose([]byte(c.in))); got != c.out {
+			t.Errorf("%q:\n got %q\nwant %q", c.in, got, c.out)
+		}
+	}
+
+	// an upgrade is kept
+	request := "GET /ws HTTP/1.1\r\nHost: a\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	conn := &peekedConn{r: strings.NewReader(request)}
+	host, peeked, err := peekHTTP(conn)
+	if err != nil || host != "a" || string(peeked) != request {
+		t.Errorf("got %q, %q, %v for an upgrade", host, peeked, err)
+	}
+}
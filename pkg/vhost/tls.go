@@ -0,0 +1,76 @@
+package vhost
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// maxHelloSize is the max bytes of the ClientHello, a record is at most
+// 16KB, some hellos with many extensions take two
+const maxHelloSize = 32 * 1024
+
+// alertUnrecognizedName is the fatal TLS alert unrecognized_name (112)
+var alertUnrecognizedName = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x70}
+
+var (
+	errHelloRead = errors.New("the hello is read")
+	errNoSNI     = errors.New("no SNI in the ClientHello")
+)
+
+// NewTLS return the router of the TLS passthrough hosts, the connections
+// are routed by the SNI of their ClientHello, and nothing is decrypted.
+// The subdomains of the tunnels are under domain.
+func NewTLS(domain string) *Router {
+	r := newRouter("tls", domain)
+	r.peek = peekTLS
+	r.reject = rejectTLS
+	return r
+}
+
+// helloConn feed the bytes of a client to the TLS server which only reads
+// the ClientHello, nothing is written back
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *helloConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func peekTLS(conn net.Conn) (string, []byte, error) {
+	peeked := &bytes.Buffer{}
+	var hello *tls.ClientHelloInfo
+	// parse the ClientHello by crypto/tls, and stop the handshake once it
+	// is read
+	err := tls.Server(&helloConn{
+		Conn: conn,
+		r:    io.TeeReader(io.LimitReader(conn, maxHelloSize), peeked),
+	}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", peeked.Bytes(), err
+	}
+	if hello.ServerName == "" {
+		return "", peeked.Bytes(), errNoSNI
+	}
+	return hello.ServerName, peeked.Bytes(), nil
+}
+
+// rejectTLS send a fatal alert, the client sees the handshake failed
+func rejectTLS(conn net.Conn, peeked []byte, host string) {
+	defer conn.Close()
+	if len(peeked) == 0 || peeked[0] != 0x16 {
+		// not TLS, or nothing to answer
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(peekTimeout))
+	conn.Write(alertUnrecognizedName)
+}
@@ -0,0 +1,56 @@
+package vhost
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/tunnel"
+)
+
+func Test_Router_TLS(t *testing.T) {
+	r := NewTLS("tunnel.example.com")
+	m, out := newTestManager(r, "tls")
+	secure, err := m.TunnelCreate(&tunnel.TunnelConfig{Proto: "tls", Subdomain: "secure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ClientHello is routed by SNI as it is
+	conn := dialRouter(r)
+	go tls.Client(conn, &tls.Config{ServerName: "Secure.tunnel.example.com"}).Handshake()
+	if tid := out.wait(t, "Secure.tunnel.example.com"); tid != secure.ID {
+		t.Errorf("routed to tunnel %d, expect %d", tid, secure.ID)
+	}
+	conn.Close()
+
+	// unknown or missing SNI is answered by the alert unrecognized_name
+	for _, name := range []string{"nobody.tunnel.example.com", ""} {
+		conn := dialRouter(r)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		err := tls.Client(conn, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+		if err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+			t.Errorf("SNI %q: got %v, expect the alert unrecognized_name", name, err)
+		}
+		conn.Close()
+	}
+
+	// not TLS, closed without answer
+	conn = dialRouter(r)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: secure.tunnel.example.com\r\n\r\n"))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("got %d bytes for a request not TLS, expect the conn closed", n)
+	}
+	conn.Close()
+
+	// the name is released with the tunnel
+	m.TunnelClose(secure.ID)
+	conn = dialRouter(r)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tls.Client(conn, &tls.Config{ServerName: "secure.tunnel.example.com"}).Handshake(); err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+		t.Errorf("got %v after the tunnel is closed, expect unrecognized_name", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,166 @@
+// Package vhost implement the listeners shared by many reverse tunnels of
+// all links in server, the connections are routed by the host name in
+// their first bytes, such as the Host header of HTTP.
+package vhost
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/es/util"
+	"github.com/sirupsen/logrus"
+)
+
+// peekTimeout is how long a connection can take to send the bytes the
+// host name is read from
+const peekTimeout = 10 * time.Second
+
+var (
+	hostRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	errNoHost = errors.New("a subdomain or domain is required")
+)
+
+// Router route the connections of a shared listener to the tunnels by
+// host name, it implements tunnel.SharedListener
+type Router struct {
+	name string
+	// domain is the parent of the subdomains
+	domain string
+
+	// peek read the host name of conn, return the bytes read
+	peek func(conn net.Conn) (string, []byte, error)
+	// reject answer a connection which can not be routed, host is empty
+	// if it is not read
+	reject func(conn net.Conn, peeked []byte, host string)
+
+	hosts   map[string]*tunnel.Tunnel
+	tunnels map[*tunnel.Tunnel][]string
+	m       sync.Mutex
+}
+
+func newRouter(name, domain string) *Router {
+	return &Router{
+		name:    name,
+		domain:  normalizeHost(domain),
+		hosts:   map[string]*tunnel.Tunnel{},
+		tunnels: map[*tunnel.Tunnel][]string{},
+	}
+}
+
+// names return the host names of tunnel config
+func (r *Router) names(cfg *tunnel.TunnelConfig) ([]string, error) {
+	names := []string{}
+	if cfg.Subdomain != "" {
+		if r.domain == "" {
+			return nil, fmt.Errorf("%s: the server has no domain for subdomain %q", r.name, cfg.Subdomain)
+		}
+		sub := normalizeHost(cfg.Subdomain)
+		if strings.Contains(sub, ".") || !hostRe.MatchString(sub) {
+			return nil, fmt.Errorf("%s: bad subdomain %q", r.name, cfg.Subdomain)
+		}
+		names = append(names, sub+"."+r.domain)
+	}
+	if cfg.Domain != "" {
+		domain := normalizeHost(cfg.Domain)
+		if !hostRe.MatchString(domain) {
+			return nil, fmt.Errorf("%s: bad domain %q", r.name, cfg.Domain)
+		}
+		names = append(names, domain)
+	}
+	if len(names) == 0 {
+		return nil, errNoHost
+	}
+	return names, nil
+}
+
+// Register claim the host names of t, all or none
+func (r *Router) Register(t *tunnel.Tunnel) error {
+	names, err := r.names(t.Config)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, name := range names {
+		if other := r.hosts[name]; other != nil && other != t {
+			return fmt.Errorf("%s: host %s is taken by another tunnel", r.name, name)
+		}
+	}
+	for _, name := range names {
+		r.hosts[name] = t
+	}
+	r.tunnels[t] = names
+	logrus.Infof("%s: route %s to tunnel %s", r.name, strings.Join(names, ", "), t)
+	return nil
+}
+
+// Unregister release the host names of t
+func (r *Router) Unregister(t *tunnel.Tunnel) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, name := range r.tunnels[t] {
+		if r.hosts[name] == t {
+			delete(r.hosts, name)
+		}
+	}
+	delete(r.tunnels, t)
+}
+
+func (r *Router) lookup(host string) *tunnel.Tunnel {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.hosts[normalizeHost(host)]
+}
+
+// Serve accept the connections of l and route them, until l is closed
+func (r *Router) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if util.TCPisClosedConnError(err) {
+				return
+			}
+			logrus.Errorf("%s: accept failed: %s", r.name, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go r.route(conn)
+	}
+}
+
+func (r *Router) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	host, peeked, err := r.peek(conn)
+	if err != nil {
+		logrus.Debugf("%s: read host of %s failed: %s", r.name, conn.RemoteAddr(), err)
+		r.reject(conn, peeked, "")
+		return
+	}
+	t := r.lookup(host)
+	if t == nil {
+		logrus.Debugf("%s: unknown host %q from %s", r.name, host, conn.RemoteAddr())
+		r.reject(conn, peeked, host)
+		return
+	}
+	// Important! cancel timeout!
+	conn.SetReadDeadline(time.Time{})
+
+	logrus.Debugf("%s: route %s of %s to tunnel %s", r.name, host, conn.RemoteAddr(), t)
+	t.ServeConn(newPeekedConn(conn, peeked))
+}
+
+// normalizeHost lower the host, and remove the port and the trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,107 @@
+package vhost
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/es/tunnel/channel"
+)
+
+// testOutbound record the frames pushed by the tunnels, instead of sending
+// them over a link
+type testOutbound struct {
+	frames chan pushedFrame
+}
+
+type pushedFrame struct {
+	tid   uint32
+	frame []byte
+}
+
+func (o *testOutbound) Push(tid uint32, cid uint32, frame []byte) error {
+	o.frames <- pushedFrame{tid, append([]byte{}, frame...)}
+	return nil
+}
+
+func (o *testOutbound) SetWeight(tid uint32, weight int) {}
+
+// wait return the tunnel which pushed a frame containing data
+func (o *testOutbound) wait(t *testing.T, data string) uint32 {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case f := <-o.frames:
+			if bytes.Contains(f.frame, []byte(data)) {
+				return f.tid
+			}
+		case <-timeout:
+			t.Fatalf("no tunnel pushed %q", data)
+		}
+	}
+}
+
+// newTestManager return the manager of a server link, its tunnels of
+// proto are registered to r
+func newTestManager(r *Router, proto string) (*tunnel.Manager, *testOutbound) {
+	out := &testOutbound{frames: make(chan pushedFrame, 100)}
+	shared := map[string]tunnel.SharedListener{proto: r}
+	return tunnel.NewManager(true, out, nil, channel.Limits{}, nil, shared, nil, false), out
+}
+
+// dialRouter return a client conn routed by r
+func dialRouter(r *Router) net.Conn {
+	client, server := net.Pipe()
+	go r.route(server)
+	return client
+}
+
+func Test_Router_Register(t *testing.T) {
+	r := NewHTTP("Tunnel.Example.com.")
+	m, _ := newTestManager(r, "http")
+
+	app, err := m.TunnelCreate(&tunnel.TunnelConfig{Proto: "http", Subdomain: "App", Domain: "app.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"app.tunnel.example.com", "APP.tunnel.example.com.:80", "app.example.org"} {
+		if r.lookup(host) != app {
+			t.Errorf("%s is not routed to the tunnel", host)
+		}
+	}
+
+	// the names are claimed all or none
+	if _, err := m.TunnelCreate(&tunnel.TunnelConfig{Proto: "http", Subdomain: "other", Domain: "app.example.org"}); err == nil {
+		t.Fatal("a taken domain should be rejected")
+	}
+	if r.lookup("other.tunnel.example.com") != nil {
+		t.Error("the free name of a rejected tunnel is claimed")
+	}
+
+	for _, cfg := range []*tunnel.TunnelConfig{
+		{Proto: "http"},
+		{Proto: "http", Subdomain: "a.b"},
+		{Proto: "http", Subdomain: "-a"},
+		{Proto: "http", Domain: "a_b.example.com"},
+	} {
+		if _, err := m.TunnelCreate(cfg); err == nil {
+			t.Errorf("%+v should be rejected", cfg)
+		}
+	}
+	if _, err := NewHTTP("").names(&tunnel.TunnelConfig{Subdomain: "app"}); err == nil {
+		t.Error("a subdomain without the domain of server should be rejected")
+	}
+
+	// the names are released when the tunnel is closed
+	if err := m.TunnelClose(app.ID); err != nil {
+		t.Fatal(err)
+	}
+	if r.lookup("app.example.org") != nil {
+		t.Error("the names of a closed tunnel are not released")
+	}
+	if _, err := m.TunnelCreate(&tunnel.TunnelConfig{Proto: "http", Domain: "app.example.org"}); err != nil {
+		t.Errorf("claim a released name: %s", err)
+	}
+}